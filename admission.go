@@ -0,0 +1,98 @@
+package whatever
+
+import (
+	"hash/fnv"
+)
+
+// AdmissionPolicy decides whether a new entry is worth evicting another one.
+// Like EvictionPolicy every shard has its own and calls it with the shard
+// mutex held.
+type AdmissionPolicy interface {
+	// Record counts an access to a key, whether it was a hit, a miss or a
+	// write.
+	Record(key string)
+	// Admit reports whether candidate should replace victim in the cache.
+	Admit(candidate string, victim string) bool
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+	// the sketch is aged once it has seen this many accesses per counter
+	sketchSampleFactor = 10
+)
+
+// TinyLFU admits a new entry only if it was accessed more often recently
+// than the entry it would evict. Frequencies are estimated with a count-min
+// sketch of small saturating counters, which are halved every
+// sketchSampleFactor*width accesses so that old popularity fades.
+type TinyLFU struct {
+	counters   []uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+// NewTinyLFU creates a filter sized for about width distinct keys.
+func NewTinyLFU(width int) *TinyLFU {
+	size := 1
+	for size < width {
+		size <<= 1
+	}
+
+	filter := new(TinyLFU)
+	filter.counters = make([]uint8, sketchDepth*size)
+	filter.mask = uint64(size - 1)
+	filter.sampleSize = sketchSampleFactor * size
+
+	return filter
+}
+
+// indexes returns the counter of the key in every row of the sketch.
+func (this *TinyLFU) indexes(key string) (indexes [sketchDepth]int) {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+
+	h1, h2 := sum&0xffffffff, sum>>32
+	for i := range indexes {
+		indexes[i] = i*int(this.mask+1) + int((h1+uint64(i)*h2)&this.mask)
+	}
+
+	return
+}
+
+func (this *TinyLFU) Record(key string) {
+	for _, i := range this.indexes(key) {
+		if this.counters[i] < sketchMaxCounter {
+			this.counters[i]++
+		}
+	}
+
+	if this.additions++; this.additions >= this.sampleSize {
+		this.age()
+	}
+}
+
+func (this *TinyLFU) Estimate(key string) (estimate uint8) {
+	estimate = sketchMaxCounter
+	for _, i := range this.indexes(key) {
+		if this.counters[i] < estimate {
+			estimate = this.counters[i]
+		}
+	}
+
+	return
+}
+
+func (this *TinyLFU) Admit(candidate string, victim string) bool {
+	return this.Estimate(candidate) > this.Estimate(victim)
+}
+
+func (this *TinyLFU) age() {
+	for i := range this.counters {
+		this.counters[i] >>= 1
+	}
+
+	this.additions /= 2
+}
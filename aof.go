@@ -0,0 +1,500 @@
+package whatever
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journal receives every change of the cache. It is called with the mutex
+// of the shard holding the entry, so that the changes of a key arrive in
+// the order they were made, and must not keep the entry.
+type journal interface {
+	record(op byte, entry *Entry)
+}
+
+// Changes are recorded as the state they leave behind rather than as the
+// commands which made them, so that replaying a change twice is harmless
+// and no command has to be executed again.
+const (
+	journalStore  = 1
+	journalDelete = 2
+	journalTouch  = 3
+	journalFlush  = 4
+	// heartbeats only appear in replication streams, see replication.go
+	journalHeartbeat = 5
+)
+
+// An append-only log starts with aofMagic and a big-endian uint16 version,
+// then every record follows as its op, the uvarint length of its payload,
+// the payload and the CRC-32 (IEEE) of op and payload. The payload of a
+// store is an entry encoded like in snapshots, a delete has the key, a touch
+// the key and the varint expiry, a flush nothing.
+const (
+	aofMagic   = "WAOF"
+	aofVersion = 1
+
+	// a log is compacted once it has grown this many times its size after
+	// the previous compaction, and at least by aofMinCompactGrowth bytes
+	aofCompactFactor    = 2
+	aofMinCompactGrowth = 1024 * 1024
+)
+
+const (
+	// FsyncAlways syncs the log after every record.
+	FsyncAlways = "always"
+	// FsyncEverySecond syncs the log once a second.
+	FsyncEverySecond = "everysec"
+	// FsyncNo leaves syncing to the operating system.
+	FsyncNo = "no"
+)
+
+// appendLog records the changes of a cache to a file, so that they can be
+// replayed after a restart.
+type appendLog struct {
+	cache  *Cache
+	path   string
+	fsync  string
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	buffer bytes.Buffer
+	size   int64
+	base   int64
+	done   chan struct{}
+
+	// while compacting, records are also kept for the new log
+	compacting bool
+	pending    bytes.Buffer
+}
+
+// openAppendLog replays the log at path into the cache, creating it if
+// needed, and starts recording the changes of the cache to it.
+func openAppendLog(cache *Cache, path string, fsync string) (aof *appendLog, err error) {
+	switch fsync {
+	case FsyncAlways, FsyncEverySecond, FsyncNo:
+	default:
+		return nil, fmt.Errorf("Unknown fsync policy %s", fsync)
+	}
+
+	aof = &appendLog{cache: cache, path: path, fsync: fsync, done: make(chan struct{})}
+
+	aof.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := aof.replay()
+	if err != nil {
+		aof.file.Close()
+		return nil, err
+	}
+	log.Printf("Replayed %d records from log %s", count, path)
+
+	aof.writer = bufio.NewWriter(aof.file)
+	aof.base = aof.size
+	cache.addJournal(aof)
+
+	if fsync != FsyncAlways {
+		go aof.flushPeriodically()
+	}
+
+	return
+}
+
+// replay applies every record of the file to the cache, truncating a torn
+// or corrupted tail left by a crash.
+func (this *appendLog) replay() (count int, err error) {
+	info, err := this.file.Stat()
+	if err != nil {
+		return
+	}
+
+	if info.Size() == 0 {
+		if _, err = this.file.Write(aofHeader()); err != nil {
+			return
+		}
+		this.size = int64(len(aofHeader()))
+		return
+	}
+
+	reader := bufio.NewReader(this.file)
+	header := make([]byte, len(aofHeader()))
+	if _, err = io.ReadFull(reader, header); err != nil || !bytes.Equal(header, aofHeader()) {
+		return 0, fmt.Errorf("%s is not a log of version %d", this.path, aofVersion)
+	}
+
+	this.size = int64(len(header))
+	maxCasid := uint64(0)
+	for {
+		op, payload, length, ok := readAppendLogRecord(reader)
+		if !ok {
+			break
+		}
+
+		entry, valid := applyRecord(this.cache, op, payload)
+		if !valid {
+			break
+		}
+
+		if entry != nil && entry.casid > maxCasid {
+			maxCasid = entry.casid
+		}
+		this.size += length
+		count++
+	}
+
+	if this.size < info.Size() {
+		log.Printf("Truncating %d bytes of torn or corrupted records at the end of log %s", info.Size()-this.size, this.path)
+		if err = this.file.Truncate(this.size); err != nil {
+			return
+		}
+	}
+
+	this.cache.continueCounter(maxCasid + 1)
+	this.cache.evict()
+
+	_, err = this.file.Seek(this.size, io.SeekStart)
+	return
+}
+
+// readAppendLogRecord returns the op and the payload of the next record and
+// its length in the file, ok being false at the end of the valid records.
+func readAppendLogRecord(reader *bufio.Reader) (op byte, payload []byte, length int64, ok bool) {
+	op, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return
+	}
+
+	// not preallocated, as the size may be garbage in a torn record
+	if payload, err = ioutil.ReadAll(io.LimitReader(reader, int64(size))); err != nil || uint64(len(payload)) != size {
+		return
+	}
+
+	var checksum uint32
+	if err = binary.Read(reader, binary.BigEndian, &checksum); err != nil {
+		return
+	}
+
+	if checksum != crc32.Update(crc32.ChecksumIEEE([]byte{op}), crc32.IEEETable, payload) {
+		return
+	}
+
+	length = int64(1 + uvarintLength(size) + len(payload) + 4)
+	ok = true
+	return
+}
+
+func uvarintLength(value uint64) int {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buffer, value)
+}
+
+// applyRecord replays a record into the cache, returning the stored entry
+// for a store. Replayed changes are not handed over to the journals, with
+// the exception of flushes.
+func applyRecord(cache *Cache, op byte, payload []byte) (entry *Entry, ok bool) {
+	reader := bytes.NewReader(payload)
+	switch op {
+	case journalStore:
+		var err error
+		if entry, err = readSnapshotEntry(reader); err != nil {
+			return nil, false
+		}
+
+		shard := cache.shard(entry.key)
+		if entry.expired(time.Now().UnixNano()) {
+			shard.forget(entry.key)
+		} else {
+			shard.restore(entry)
+		}
+	case journalDelete:
+		cache.shard(string(payload)).forget(string(payload))
+	case journalTouch:
+		key, err := readSnapshotBytes(reader)
+		if err != nil {
+			return nil, false
+		}
+
+		expires, err := binary.ReadVarint(reader)
+		if err != nil {
+			return nil, false
+		}
+
+		cache.shard(string(key)).retouch(string(key), expires)
+	case journalFlush:
+		cache.clear()
+	default:
+		return nil, false
+	}
+
+	ok = true
+	return
+}
+
+func aofHeader() []byte {
+	header := []byte(aofMagic)
+	return append(header, byte(aofVersion>>8), byte(aofVersion))
+}
+
+// writeRecord appends the record of a change to buffer.
+func writeRecord(buffer *bytes.Buffer, op byte, entry *Entry) {
+	var payload bytes.Buffer
+	switch op {
+	case journalStore:
+		writeSnapshotEntry(&payload, entry)
+	case journalDelete:
+		payload.WriteString(entry.key)
+	case journalTouch:
+		writeUvarint(&payload, uint64(len(entry.key)))
+		payload.WriteString(entry.key)
+		writeVarint(&payload, entry.expires)
+	}
+
+	writeRecordPayload(buffer, op, payload.Bytes())
+}
+
+func writeRecordPayload(buffer *bytes.Buffer, op byte, payload []byte) {
+	buffer.WriteByte(op)
+	writeUvarint(buffer, uint64(len(payload)))
+	buffer.Write(payload)
+
+	checksum := crc32.Update(crc32.ChecksumIEEE([]byte{op}), crc32.IEEETable, payload)
+	binary.Write(buffer, binary.BigEndian, checksum)
+}
+
+// encode turns a change into a record, which stays valid until the next
+// call. The caller holds the mutex.
+func (this *appendLog) encode(op byte, entry *Entry) []byte {
+	this.buffer.Reset()
+	writeRecord(&this.buffer, op, entry)
+	return this.buffer.Bytes()
+}
+
+func (this *appendLog) record(op byte, entry *Entry) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		return
+	}
+
+	record := this.encode(op, entry)
+	if this.compacting {
+		this.pending.Write(record)
+	}
+
+	if _, err := this.writer.Write(record); err != nil {
+		log.Printf("Cannot write to log %s: %s", this.path, err)
+		return
+	}
+	this.size += int64(len(record))
+
+	if this.fsync == FsyncAlways {
+		this.sync()
+	}
+
+	if !this.compacting && this.size > this.base*aofCompactFactor && this.size-this.base > aofMinCompactGrowth {
+		this.compacting = true
+		go this.compact()
+	}
+}
+
+// sync flushes the buffer and, unless the policy leaves it to the operating
+// system, syncs the file. The caller holds the mutex.
+func (this *appendLog) sync() {
+	if err := this.writer.Flush(); err != nil {
+		log.Printf("Cannot write to log %s: %s", this.path, err)
+		return
+	}
+
+	if this.fsync != FsyncNo {
+		if err := this.file.Sync(); err != nil {
+			log.Printf("Cannot sync log %s: %s", this.path, err)
+		}
+	}
+}
+
+func (this *appendLog) flushPeriodically() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+			this.mutex.Lock()
+			if this.file != nil {
+				this.sync()
+			}
+			this.mutex.Unlock()
+		}
+	}
+}
+
+// Compact rewrites the log from the current contents of the cache.
+func (this *appendLog) Compact() error {
+	this.mutex.Lock()
+	if this.compacting {
+		this.mutex.Unlock()
+		return errors.New("Log compaction already in progress")
+	}
+	this.compacting = true
+	this.mutex.Unlock()
+
+	return this.compact()
+}
+
+// compact writes every entry to a new log while changes keep being appended
+// to the current one and kept aside since compacting was set. Those are appended to the new log
+// before it replaces the current one: the shards are dumped one at a time,
+// so some of them may already be part of the dump, which is fine as
+// replaying a record twice is harmless.
+func (this *appendLog) compact() (err error) {
+	defer func() {
+		this.mutex.Lock()
+		this.compacting = false
+		this.pending.Reset()
+		this.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("Cannot compact log %s: %s", this.path, err)
+		}
+	}()
+
+	file, err := os.CreateTemp(filepath.Dir(this.path), filepath.Base(this.path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	writer.Write(aofHeader())
+	for _, shard := range this.cache.shards {
+		if err = shard.dump(this, writer); err != nil {
+			file.Close()
+			return
+		}
+	}
+
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		file.Close()
+		return errors.New("Log closed")
+	}
+
+	if _, err = file.Write(this.pending.Bytes()); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), this.path)
+	}
+	if err != nil {
+		file.Close()
+		return
+	}
+
+	this.writer.Flush()
+	this.file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+
+	this.file = file
+	this.writer = bufio.NewWriter(file)
+	this.size = info.Size()
+	this.base = this.size
+	log.Printf("Compacted log %s to %d bytes", this.path, this.size)
+	return
+}
+
+// Close flushes and syncs the log and stops recording to it.
+func (this *appendLog) Close() (err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.file == nil {
+		return
+	}
+
+	this.cache.removeJournal(this)
+	close(this.done)
+	if err = this.writer.Flush(); err == nil {
+		err = this.file.Sync()
+	}
+	if closeErr := this.file.Close(); err == nil {
+		err = closeErr
+	}
+	this.file = nil
+
+	return
+}
+
+// dump writes a store record for every entry of the shard.
+func (this *shard) dump(appendLog *appendLog, writer *bufio.Writer) (err error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, entry := range this.m {
+		if entry.expired(now) {
+			continue
+		}
+
+		// encode uses the buffer of the log, which its mutex guards
+		appendLog.mutex.Lock()
+		_, err = writer.Write(appendLog.encode(journalStore, entry))
+		appendLog.mutex.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// forget deletes an entry without it being recorded.
+func (this *shard) forget(key string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if entry, found := this.m[key]; found {
+		this.remove(entry)
+	}
+}
+
+// retouch sets the expiry of an entry without it being recorded.
+func (this *shard) retouch(key string, expires int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if entry, found := this.m[key]; found {
+		entry.expires = expires
+	}
+}
@@ -0,0 +1,449 @@
+package whatever
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	binaryMagicRequest  = 0x80
+	binaryMagicResponse = 0x81
+	binaryHeaderLength  = 24
+
+	opGet     = 0x00
+	opSet     = 0x01
+	opAdd     = 0x02
+	opReplace = 0x03
+	opDelete  = 0x04
+	opIncr    = 0x05
+	opDecr    = 0x06
+	opQuit    = 0x07
+	opFlush   = 0x08
+	opGetQ    = 0x09
+	opNoop    = 0x0a
+	opVersion = 0x0b
+	opGetK    = 0x0c
+	opGetKQ   = 0x0d
+	opAppend  = 0x0e
+	opPrepend = 0x0f
+	opStat    = 0x10
+
+	statusOk           = 0x0000
+	statusNotFound     = 0x0001
+	statusExists       = 0x0002
+	statusTooLarge     = 0x0003
+	statusInvalidArgs  = 0x0004
+	statusNotStored    = 0x0005
+	statusNonNumeric   = 0x0006
+	statusUnknownCmd   = 0x0081
+	statusNotSupported = 0x0083
+
+	// incr/decr requests with this expiration must not create missing keys
+	noInitialExpiration = 0xffffffff
+)
+
+// binaryHeader is the fixed header of memcached binary protocol packets. In
+// requests the status field holds the vbucket id, which this server reads as
+// the entry priority instead.
+type binaryHeader struct {
+	magic        uint8
+	opcode       uint8
+	keyLength    uint16
+	extrasLength uint8
+	dataType     uint8
+	status       uint16
+	bodyLength   uint32
+	opaque       uint32
+	cas          uint64
+}
+
+type binaryRequest struct {
+	header binaryHeader
+	extras []byte
+	key    []byte
+	value  []byte
+	// rejected is the status of a request which exceeds the limits, whose
+	// body is skipped instead of read
+	rejected uint16
+}
+
+func (this *session) serveBinary() {
+	for {
+		if !this.idle() {
+			// responses held back for pipelining still go out
+			this.rw.Write(this.response.Bytes())
+			this.rw.Flush()
+			return
+		}
+
+		request, err := this.readBinaryRequest()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			this.broken(err)
+			return
+		}
+
+		if !this.active() {
+			return
+		}
+
+		this.commands++
+
+		quit := this.runBinaryCmd(request)
+
+		// hold responses back while the client is still pipelining requests
+		if this.rw.Reader.Buffered() == 0 || quit {
+			if _, err = this.rw.Write(this.response.Bytes()); err != nil {
+				this.broken(err)
+				return
+			}
+
+			if err = this.rw.Flush(); err != nil {
+				this.broken(err)
+				return
+			}
+
+			this.response.Reset()
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+func (this *session) readBinaryRequest() (request *binaryRequest, err error) {
+	var buffer [binaryHeaderLength]byte
+	if _, err = io.ReadFull(this.rw, buffer[:]); err != nil {
+		return
+	}
+
+	request = new(binaryRequest)
+	header := &request.header
+	header.magic = buffer[0]
+	header.opcode = buffer[1]
+	header.keyLength = binary.BigEndian.Uint16(buffer[2:])
+	header.extrasLength = buffer[4]
+	header.dataType = buffer[5]
+	header.status = binary.BigEndian.Uint16(buffer[6:])
+	header.bodyLength = binary.BigEndian.Uint32(buffer[8:])
+	header.opaque = binary.BigEndian.Uint32(buffer[12:])
+	header.cas = binary.BigEndian.Uint64(buffer[16:])
+
+	if header.magic != binaryMagicRequest {
+		return nil, fmt.Errorf("Invalid magic byte 0x%x", header.magic)
+	}
+
+	if int(header.extrasLength)+int(header.keyLength) > int(header.bodyLength) {
+		return nil, fmt.Errorf("Invalid body length %d", header.bodyLength)
+	}
+
+	valueLength := int(header.bodyLength) - int(header.extrasLength) - int(header.keyLength)
+	if int(header.keyLength) > this.server.maxKeyLength {
+		request.rejected = statusInvalidArgs
+	} else if valueLength > this.server.maxValueLength {
+		request.rejected = statusTooLarge
+	}
+
+	if request.rejected != statusOk {
+		_, err = io.CopyN(ioutil.Discard, this.rw, int64(header.bodyLength))
+		return
+	}
+
+	body := make([]byte, header.bodyLength)
+	if _, err = io.ReadFull(this.rw, body); err != nil {
+		return
+	}
+
+	request.extras = body[:header.extrasLength]
+	request.key = body[header.extrasLength : int(header.extrasLength)+int(header.keyLength)]
+	request.value = body[int(header.extrasLength)+int(header.keyLength):]
+
+	if validateKey(request.key, this.server.maxKeyLength) != "" {
+		request.rejected = statusInvalidArgs
+	}
+
+	return
+}
+
+func (this *session) writeBinaryResponse(request *binaryRequest, status uint16, cas uint64, extras []byte, key []byte, value []byte) {
+	var buffer [binaryHeaderLength]byte
+	buffer[0] = binaryMagicResponse
+	buffer[1] = request.header.opcode
+	binary.BigEndian.PutUint16(buffer[2:], uint16(len(key)))
+	buffer[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(buffer[6:], status)
+	binary.BigEndian.PutUint32(buffer[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buffer[12:], request.header.opaque)
+	binary.BigEndian.PutUint64(buffer[16:], cas)
+
+	this.response.Write(buffer[:])
+	this.response.Write(extras)
+	this.response.Write(key)
+	this.response.Write(value)
+}
+
+func (this *session) writeBinaryError(request *binaryRequest, status uint16, message string) {
+	this.writeBinaryResponse(request, status, 0, nil, nil, []byte(message))
+}
+
+// runBinaryCmd executes a single request and reports whether the connection
+// should be closed afterwards.
+func (this *session) runBinaryCmd(request *binaryRequest) (quit bool) {
+	log.Printf("Received binary command 0x%02x: key=\"%s\"", request.header.opcode, request.key)
+
+	switch request.rejected {
+	case statusInvalidArgs:
+		this.writeBinaryError(request, statusInvalidArgs, "Invalid key")
+		return false
+	case statusTooLarge:
+		this.writeBinaryError(request, statusTooLarge, "Too large")
+		return false
+	}
+
+	switch request.header.opcode {
+	case opSet, opAdd, opReplace, opAppend, opPrepend, opDelete, opIncr, opDecr, opFlush:
+		if this.server.primary != "" {
+			this.writeBinaryError(request, statusNotSupported, "Read-only replica")
+			return false
+		}
+	}
+
+	switch request.header.opcode {
+	case opGet, opGetQ, opGetK, opGetKQ:
+		this.runBinaryGetCmd(request)
+	case opSet, opAdd, opReplace:
+		this.runBinaryStoreCmd(request)
+	case opAppend, opPrepend:
+		this.runBinaryConcatCmd(request)
+	case opDelete:
+		this.runBinaryDeleteCmd(request)
+	case opIncr, opDecr:
+		this.runBinaryArithmeticCmd(request)
+	case opFlush:
+		this.runBinaryFlushCmd(request)
+	case opStat:
+		this.runBinaryStatCmd(request)
+	case opNoop:
+		this.writeBinaryResponse(request, statusOk, 0, nil, nil, nil)
+	case opVersion:
+		this.writeBinaryResponse(request, statusOk, 0, nil, nil, []byte(version))
+	case opQuit:
+		this.writeBinaryResponse(request, statusOk, 0, nil, nil, nil)
+		return true
+	default:
+		log.Printf("Received nonexistent binary command 0x%02x", request.header.opcode)
+		this.writeBinaryError(request, statusUnknownCmd, "Unknown command")
+	}
+
+	return false
+}
+
+func (this *session) runBinaryGetCmd(request *binaryRequest) {
+	opcode := request.header.opcode
+	quiet := opcode == opGetQ || opcode == opGetKQ
+
+	var key []byte
+	if opcode == opGetK || opcode == opGetKQ {
+		key = request.key
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdGet, 1)
+	value, flags, _, casid, ok := this.server.cache.Gets(string(request.key))
+	if !ok {
+		atomic.AddUint64(&this.server.stats.getMisses, 1)
+		log.Printf("Cache miss for key=\"%s\"", request.key)
+		if !quiet {
+			this.writeBinaryResponse(request, statusNotFound, 0, nil, key, []byte("Not found"))
+		}
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.getHits, 1)
+	log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, request.key)
+
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, uint32(flags))
+	this.writeBinaryResponse(request, statusOk, casid, extras, key, value)
+}
+
+// storeExtras decodes the flags and expiration of set/add/replace. A third
+// 4-byte field, if present, carries the priority, which otherwise is taken
+// from the vbucket id.
+func storeExtras(request *binaryRequest) (priority uint64, flags uint64, exptime uint64, ok bool) {
+	extras := request.extras
+	if len(extras) != 8 && len(extras) != 12 {
+		return
+	}
+
+	flags = uint64(binary.BigEndian.Uint32(extras))
+	exptime = uint64(binary.BigEndian.Uint32(extras[4:]))
+	if len(extras) == 12 {
+		priority = uint64(binary.BigEndian.Uint32(extras[8:]))
+	} else {
+		priority = uint64(request.header.status)
+	}
+
+	ok = true
+	return
+}
+
+func (this *session) runBinaryStoreCmd(request *binaryRequest) {
+	priority, flags, exptime, ok := storeExtras(request)
+	if !ok || len(request.key) == 0 {
+		this.writeBinaryError(request, statusInvalidArgs, "Invalid arguments")
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	key := string(request.key)
+
+	cache := this.server.cache
+	var stored Entry
+	status := uint16(statusOk)
+	switch {
+	case request.header.cas != 0 && request.header.opcode != opAdd:
+		if entry, ok := cache.CheckAndStore(key, request.value, priority, flags, exptime, request.header.cas); ok {
+			stored = *entry
+		} else if entry == nil {
+			status = statusNotFound
+		} else {
+			status = statusExists
+		}
+	case request.header.opcode == opSet:
+		if stored, ok = cache.Set(key, request.value, priority, flags, exptime); !ok {
+			status = statusNotStored
+		}
+	case request.header.opcode == opAdd:
+		if stored, ok = cache.Add(key, request.value, priority, flags, exptime); !ok {
+			status = statusExists
+		}
+	case request.header.opcode == opReplace:
+		if stored, ok = cache.Replace(key, request.value, priority, flags, exptime); !ok {
+			status = statusNotFound
+		}
+	}
+
+	this.writeBinaryStoreResult(request, stored.casid, status)
+}
+
+func (this *session) runBinaryConcatCmd(request *binaryRequest) {
+	if len(request.extras) != 0 || len(request.key) == 0 {
+		this.writeBinaryError(request, statusInvalidArgs, "Invalid arguments")
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	key := string(request.key)
+	priority := uint64(request.header.status)
+
+	var stored Entry
+	var ok bool
+	if request.header.opcode == opAppend {
+		stored, ok = this.server.cache.Append(key, request.value, priority, 0, 0)
+	} else {
+		stored, ok = this.server.cache.Prepend(key, request.value, priority, 0, 0)
+	}
+
+	if ok {
+		this.writeBinaryStoreResult(request, stored.casid, statusOk)
+	} else {
+		this.writeBinaryStoreResult(request, 0, statusNotStored)
+	}
+}
+
+// writeBinaryStoreResult replies to a storage command, reporting the casid
+// the write gave the entry.
+func (this *session) writeBinaryStoreResult(request *binaryRequest, casid uint64, status uint16) {
+	switch status {
+	case statusOk:
+		this.writeBinaryResponse(request, statusOk, casid, nil, nil, nil)
+	case statusNotFound:
+		this.writeBinaryError(request, status, "Not found")
+	case statusExists:
+		this.writeBinaryError(request, status, "Data exists for key")
+	default:
+		this.writeBinaryError(request, status, "Not stored")
+	}
+}
+
+func (this *session) runBinaryDeleteCmd(request *binaryRequest) {
+	if this.server.cache.Delete(string(request.key)) {
+		this.writeBinaryResponse(request, statusOk, 0, nil, nil, nil)
+	} else {
+		this.writeBinaryError(request, statusNotFound, "Not found")
+	}
+}
+
+func (this *session) runBinaryArithmeticCmd(request *binaryRequest) {
+	if len(request.extras) != 20 || len(request.key) == 0 {
+		this.writeBinaryError(request, statusInvalidArgs, "Invalid arguments")
+		return
+	}
+
+	delta := binary.BigEndian.Uint64(request.extras)
+	initial := binary.BigEndian.Uint64(request.extras[8:])
+	exptime := binary.BigEndian.Uint32(request.extras[16:])
+	key := string(request.key)
+
+	var entry *Entry
+	var value uint64
+	var ok bool
+	if request.header.opcode == opIncr {
+		entry, value, ok = this.server.cache.Incr(key, delta)
+	} else {
+		entry, value, ok = this.server.cache.Decr(key, delta)
+	}
+
+	if entry == nil {
+		if exptime == noInitialExpiration {
+			this.writeBinaryError(request, statusNotFound, "Not found")
+			return
+		}
+
+		value = initial
+		stored, ok := this.server.cache.Add(key, []byte(strconv.FormatUint(initial, 10)), uint64(request.header.status), 0, uint64(exptime))
+		if !ok {
+			this.writeBinaryError(request, statusExists, "Data exists for key")
+			return
+		}
+		entry = &stored
+	} else if !ok {
+		this.writeBinaryError(request, statusNonNumeric, "Non-numeric server-side value for incr or decr")
+		return
+	}
+
+	result := make([]byte, 8)
+	binary.BigEndian.PutUint64(result, value)
+	this.writeBinaryResponse(request, statusOk, entry.casid, nil, nil, result)
+}
+
+func (this *session) runBinaryFlushCmd(request *binaryRequest) {
+	var delay uint64
+	if len(request.extras) == 4 {
+		delay = uint64(binary.BigEndian.Uint32(request.extras))
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdFlush, 1)
+	this.server.cache.Flush(delay)
+	this.writeBinaryResponse(request, statusOk, 0, nil, nil, nil)
+}
+
+func (this *session) runBinaryStatCmd(request *binaryRequest) {
+	stats, ok := this.server.collectStats(string(request.key))
+	if !ok {
+		this.writeBinaryError(request, statusNotFound, "Not found")
+		return
+	}
+
+	for _, stat := range stats {
+		this.writeBinaryResponse(request, statusOk, 0, nil, []byte(stat.name), []byte(fmt.Sprint(stat.value)))
+	}
+	this.writeBinaryResponse(request, statusOk, 0, nil, nil, nil)
+}
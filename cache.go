@@ -1,17 +1,75 @@
 package whatever
 
 import (
-	"container/list"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
+const (
+	// exptime values above this are absolute Unix timestamps, like in memcached
+	maxRelativeExptime = 60 * 60 * 24 * 30
+
+	sweepInterval   = time.Second
+	sweepSampleSize = 20
+
+	// DefaultShardCount is the number of shards of a cache made by NewCache.
+	DefaultShardCount = 16
+
+	// a map slot holds the string header of the key, the entry pointer and a
+	// hash byte, and Go maps are about 80% full on average
+	mapSlotOverhead = (16 + 8 + 1) * 5 / 4
+)
+
+// entryOverhead is the memory an entry takes besides its key, its value and
+// the handle its eviction policy tracks it with: the Entry itself and its
+// share of the map buckets.
+var entryOverhead = int(unsafe.Sizeof(Entry{})) + mapSlotOverhead
+
+// Cache is split into shards selected by a hash of the key, each with its
+// own mutex, so that operations on different keys rarely contend. The byte
+// budget is shared: whenever it is exceeded the victims of all shards are
+// compared and the best one is evicted, so the eviction order stays close
+// to the one of a single policy over the whole cache.
 type Cache struct {
-	maxLength int
-	l         *list.List
-	m         map[string]*list.Element
-	mutex     sync.Mutex
+	// length and counter are shared by the shards and updated atomically,
+	// they come first to stay 64-bit aligned
+	length    int64
 	counter   uint64
-	length    int
+	maxLength int
+	shards    []*shard
+	done      chan struct{}
+	// journals holds a []journal, replaced as a whole under journalMutex
+	journals     atomic.Value
+	journalMutex sync.Mutex
+
+	evictMutex sync.Mutex
+	flushMutex sync.Mutex
+	flush      *time.Timer
+}
+
+// CacheStats is a point-in-time snapshot of the cache counters. Bytes is
+// what the budget MaxBytes is enforced against, the sum of PayloadBytes,
+// the values, and OverheadBytes, the keys and the bookkeeping of entries.
+type CacheStats struct {
+	Items         int
+	TotalItems    uint64
+	Bytes         int
+	PayloadBytes  int
+	OverheadBytes int
+	MaxBytes      int
+	Evictions     uint64
+	Reclaimed     uint64
+	Rejections    uint64
+	Priorities    map[uint64]PriorityStats
+	// Slabs is nil unless slabs are enabled
+	Slabs []SlabStats
+}
+
+type PriorityStats struct {
+	Items int
+	Bytes int
 }
 
 type Entry struct {
@@ -20,202 +78,347 @@ type Entry struct {
 	priority uint64
 	flags    uint64
 	casid    uint64
+	expires  int64
+	accessed int64
+	fetched  bool
+	// inserted orders entries by the time they were stored
+	inserted uint64
+
+	// handle is owned by the eviction policy the entry is tracked by
+	handle interface{}
 }
 
 func NewCache(maxLength int) *Cache {
+	return NewShardedCache(maxLength, DefaultShardCount)
+}
+
+// NewShardedCache creates a cache split into the given number of shards.
+func NewShardedCache(maxLength int, shards int) *Cache {
+	if shards < 1 {
+		shards = 1
+	}
+
 	cache := new(Cache)
 	cache.maxLength = maxLength
-	cache.m = make(map[string]*list.Element)
-	cache.l = list.New()
+	// casid 0 means "no casid" in the binary protocol
+	cache.counter = 1
+	cache.shards = make([]*shard, shards)
+	for i := range cache.shards {
+		cache.shards[i] = newShard(cache)
+	}
+	cache.done = make(chan struct{})
+
+	go cache.sweep()
 
 	return cache
 }
 
-func (this *Cache) Set(key string, value []byte, priority uint64, flags uint64, exptime uint64) {
-	this.mutex.Lock()
-	defer this.evict()
-	defer this.mutex.Unlock()
-
-	if element, ok := this.m[key]; ok {
-		entry := element.Value.(*Entry)
-		this.length -= len(entry.value)
-		entry.value = value
-		this.length += len(value)
-		entry.priority = priority
-		entry.casid = this.counter
-	} else {
-		var position *list.Element
-		for i := this.l.Front(); i != nil && i.Value.(*Entry).priority < priority; i = i.Next() {
-			position = i
-		}
+// Close stops the background sweeper.
+func (this *Cache) Close() {
+	close(this.done)
+}
 
-		if position == nil {
-			this.m[key] = this.l.PushFront(&Entry{key: key, value: value, priority: priority, flags: flags, casid: this.counter})
-		} else {
-			this.m[key] = this.l.InsertAfter(&Entry{key: key, value: value, priority: priority, flags: flags, casid: this.counter}, position)
-		}
-		this.length += len(value)
+// expiration converts a memcached exptime into an absolute expiry in
+// nanoseconds since the epoch, 0 meaning the entry never expires.
+func expiration(exptime uint64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime <= maxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second).UnixNano()
 	}
 
-	this.counter++
+	return time.Unix(int64(exptime), 0).UnixNano()
 }
 
-func (this *Cache) Add(key string, value []byte, priority uint64, flags uint64, exptime uint64) (ok bool) {
-	this.mutex.Lock()
-	defer this.evict()
-	defer this.mutex.Unlock()
+func (this *Entry) expired(now int64) bool {
+	return this.expires != 0 && this.expires <= now
+}
 
-	_, ok = this.m[key]
-	if !ok {
-		var position *list.Element
-		for i := this.l.Front(); i != nil && i.Value.(*Entry).priority < priority; i = i.Next() {
-			position = i
-		}
+func (this *Entry) Key() string {
+	return this.key
+}
 
-		if position == nil {
-			this.m[key] = this.l.PushFront(&Entry{key: key, value: value, priority: priority, flags: flags, casid: this.counter})
-		} else {
-			this.m[key] = this.l.InsertAfter(&Entry{key: key, value: value, priority: priority, flags: flags, casid: this.counter}, position)
-		}
-		this.length += len(value)
+func (this *Entry) Size() int {
+	return len(this.value)
+}
 
-		this.counter++
-	}
+// footprint estimates the memory taken by an entry tracked by policy, spare
+// capacity of the value included.
+func footprint(key string, value []byte, policy EvictionPolicy) int {
+	return entryOverhead + handleSize(policy) + len(key) + cap(value)
+}
+
+func (this *Entry) Priority() uint64 {
+	return this.priority
+}
 
-	return !ok
+// fetch records a read of the entry.
+func (this *Entry) fetch() {
+	this.accessed = time.Now().UnixNano()
+	this.fetched = true
 }
 
-func (this *Cache) Replace(key string, value []byte, priority uint64, flags uint64, exptime uint64) (ok bool) {
-	this.mutex.Lock()
+// Set stores a value unconditionally, unless the admission policy rejects
+// a new key. Like every write, it returns a copy of the entry as it was
+// stored, whose casid is the one the write was given.
+func (this *Cache) Set(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
 	defer this.evict()
-	defer this.mutex.Unlock()
+	return this.shard(key).Set(key, value, priority, flags, exptime)
+}
 
-	element, ok := this.m[key]
-	if ok {
-		entry := element.Value.(*Entry)
-		this.length -= len(entry.value)
-		entry.value = value
-		this.length += len(value)
-		entry.priority = priority
-		entry.casid = this.counter
+func (this *Cache) Add(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	defer this.evict()
+	return this.shard(key).Add(key, value, priority, flags, exptime)
+}
 
-		this.counter++
-	}
+func (this *Cache) Replace(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	defer this.evict()
+	return this.shard(key).Replace(key, value, priority, flags, exptime)
+}
 
-	return
+func (this *Cache) Append(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	defer this.evict()
+	return this.shard(key).Append(key, value, priority, flags, exptime)
 }
 
-func (this *Cache) Append(key string, value []byte, priority uint64, flags uint64, exptime uint64) (ok bool) {
-	this.mutex.Lock()
+func (this *Cache) Prepend(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
 	defer this.evict()
-	defer this.mutex.Unlock()
+	return this.shard(key).Prepend(key, value, priority, flags, exptime)
+}
 
-	element, ok := this.m[key]
-	if ok {
-		entry := element.Value.(*Entry)
-		entry.value = append(entry.value, value...)
-		this.length += len(value)
-		entry.priority = priority
-		entry.casid = this.counter
+// CheckAndStore stores a value only if the casid of the entry matches. A
+// nil entry means the key is missing, otherwise it is a copy of the entry
+// as stored or, if the casid did not match, as found.
+func (this *Cache) CheckAndStore(key string, value []byte, priority uint64, flags uint64, exptime uint64, casid uint64) (entry *Entry, ok bool) {
+	defer this.evict()
+	return this.shard(key).CheckAndStore(key, value, priority, flags, exptime, casid)
+}
 
-		this.counter++
-	}
+// Incr adds delta to a decimal value, wrapping around at 64 bits. A nil
+// entry means the key is missing, otherwise it is a copy of the updated
+// entry, ok being false if the value is not a number.
+func (this *Cache) Incr(key string, delta uint64) (entry *Entry, value uint64, ok bool) {
+	defer this.evict()
+	return this.shard(key).arithmetic(key, delta, false)
+}
+
+// Decr subtracts delta from a decimal value, never going below zero.
+func (this *Cache) Decr(key string, delta uint64) (entry *Entry, value uint64, ok bool) {
+	defer this.evict()
+	return this.shard(key).arithmetic(key, delta, true)
+}
 
+func (this *Cache) Get(key string) (value []byte, flags uint64, size uint64, ok bool) {
+	value, flags, size, _, ok = this.shard(key).Gets(key)
 	return
 }
 
-func (this *Cache) Prepend(key string, value []byte, priority uint64, flags uint64, exptime uint64) (ok bool) {
-	this.mutex.Lock()
-	defer this.evict()
-	defer this.mutex.Unlock()
+func (this *Cache) Gets(key string) (value []byte, flags uint64, size uint64, casid uint64, ok bool) {
+	return this.shard(key).Gets(key)
+}
+
+// Touch updates the expiry of an entry without touching its value.
+func (this *Cache) Touch(key string, exptime uint64) bool {
+	return this.shard(key).Touch(key, exptime)
+}
+
+// GetAndTouch works like Gets but also updates the expiry of the entry.
+func (this *Cache) GetAndTouch(key string, exptime uint64) (value []byte, flags uint64, size uint64, casid uint64, ok bool) {
+	return this.shard(key).GetAndTouch(key, exptime)
+}
+
+// Peek returns a copy of an entry without recording an access.
+func (this *Cache) Peek(key string) (entry Entry, ok bool) {
+	return this.shard(key).Peek(key)
+}
+
+// MetaGet returns a copy of an entry as it was before this access, so that
+// the previous access time and fetched state can be reported, then records
+// the access and, if touch is set, updates the expiry.
+func (this *Cache) MetaGet(key string, touch bool, exptime uint64) (entry Entry, ok bool) {
+	return this.shard(key).MetaGet(key, touch, exptime)
+}
 
-	element, ok := this.m[key]
-	if ok {
-		entry := element.Value.(*Entry)
-		entry.value = append(value, entry.value...)
-		this.length += len(value)
-		entry.priority = priority
-		entry.casid = this.counter
+// CheckAndDelete deletes an entry only if its casid matches. A nil entry
+// means the key is missing.
+func (this *Cache) CheckAndDelete(key string, casid uint64) (entry *Entry, ok bool) {
+	return this.shard(key).CheckAndDelete(key, casid)
+}
+
+func (this *Cache) Delete(key string) bool {
+	return this.shard(key).Delete(key)
+}
 
-		this.counter++
+// Flush invalidates every entry, either right away or, if delay is not
+// zero, at the time it denotes (using the same rules as exptime). A later
+// call cancels a pending delayed flush.
+func (this *Cache) Flush(delay uint64) {
+	this.flushMutex.Lock()
+	defer this.flushMutex.Unlock()
+
+	if this.flush != nil {
+		this.flush.Stop()
+		this.flush = nil
 	}
 
-	return
+	if delay == 0 {
+		this.clear()
+		return
+	}
+
+	this.flush = time.AfterFunc(time.Duration(expiration(delay)-time.Now().UnixNano()), this.clear)
 }
 
-func (this *Cache) CheckAndStore(key string, value []byte, priority uint64, flags uint64, exptime uint64, casid uint64) (entry *Entry, ok bool) {
-	this.mutex.Lock()
-	defer this.evict()
-	defer this.mutex.Unlock()
-
-	element, ok := this.m[key]
-	if ok {
-		entry = element.Value.(*Entry)
-		if entry.casid == casid {
-			this.length -= len(entry.value)
-			entry.value = value
-			this.length += len(value)
-			entry.priority = priority
-			entry.casid = this.counter
-
-			this.counter++
+// SetAdmissionPolicy installs a filter for new keys that would cause an
+// eviction, nil admitting everything. Every shard gets its own filter made
+// by newAdmission.
+func (this *Cache) SetAdmissionPolicy(newAdmission func() AdmissionPolicy) {
+	for _, shard := range this.shards {
+		if newAdmission == nil {
+			shard.setAdmissionPolicy(nil)
 		} else {
-			ok = false
+			shard.setAdmissionPolicy(newAdmission())
 		}
 	}
-
-	return
 }
 
-func (this *Cache) Get(key string) (value []byte, flags uint64, size uint64, ok bool) {
-	this.mutex.Lock()
-	defer this.mutex.Unlock()
+// EnableSlabs makes the cache store values in slab chunks which are reused
+// once their entries leave, see slabAllocator. Reads then return copies of
+// the values. There is no way back, the chunks are never given back to the
+// runtime.
+func (this *Cache) EnableSlabs() {
+	for _, shard := range this.shards {
+		shard.enableSlabs()
+	}
+}
 
-	element, ok := this.m[key]
-	if ok {
-		entry := element.Value.(*Entry)
-		value = entry.value
-		flags = entry.flags
-		size = uint64(len(value))
+// clear holds every shard mutex at once, so that the flush has a single
+// place among the changes handed to the journal.
+func (this *Cache) clear() {
+	for _, shard := range this.shards {
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
 	}
 
-	return
+	this.record(journalFlush, nil)
+
+	for _, shard := range this.shards {
+		shard.clear()
+	}
 }
 
-func (this *Cache) Gets(key string) (value []byte, flags uint64, size uint64, casid uint64, ok bool) {
-	this.mutex.Lock()
-	defer this.mutex.Unlock()
+// SetEvictionPolicy replaces the eviction policy, handing every stored entry
+// over to the new one. Every shard gets its own policy made by newPolicy.
+func (this *Cache) SetEvictionPolicy(newPolicy func() EvictionPolicy) {
+	for _, shard := range this.shards {
+		shard.setEvictionPolicy(newPolicy())
+	}
+}
 
-	element, ok := this.m[key]
-	if ok {
-		entry := element.Value.(*Entry)
-		value = entry.value
-		flags = entry.flags
-		size = uint64(len(value))
-		casid = entry.casid
+func (this *Cache) Stats() (stats CacheStats) {
+	stats.Priorities = make(map[uint64]PriorityStats)
+	for _, shard := range this.shards {
+		shard.stats(&stats)
 	}
 
+	stats.MaxBytes = this.maxLength
 	return
 }
 
-func (this *Cache) Delete(key string) bool {
-	this.mutex.Lock()
-	defer this.mutex.Unlock()
+// addJournal starts handing every change over to j.
+func (this *Cache) addJournal(j journal) {
+	this.journalMutex.Lock()
+	defer this.journalMutex.Unlock()
+
+	journals, _ := this.journals.Load().([]journal)
+	this.journals.Store(append(append([]journal(nil), journals...), j))
+}
 
-	element, ok := this.m[key]
-	if ok {
-		entry := this.l.Remove(element).(*Entry)
-		this.length -= len(entry.value)
-		delete(this.m, key)
+func (this *Cache) removeJournal(j journal) {
+	this.journalMutex.Lock()
+	defer this.journalMutex.Unlock()
+
+	journals, _ := this.journals.Load().([]journal)
+	remaining := make([]journal, 0, len(journals))
+	for _, other := range journals {
+		if other != j {
+			remaining = append(remaining, other)
+		}
 	}
+	this.journals.Store(remaining)
+}
 
-	return ok
+// record hands a change over to every journal.
+func (this *Cache) record(op byte, entry *Entry) {
+	journals, _ := this.journals.Load().([]journal)
+	for _, j := range journals {
+		j.record(op, entry)
+	}
 }
 
+// shard picks the shard of a key by its FNV-1a hash.
+func (this *Cache) shard(key string) *shard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return this.shards[hash%uint32(len(this.shards))]
+}
+
+// next hands out casids, which are unique across the shards.
+func (this *Cache) next() uint64 {
+	return atomic.AddUint64(&this.counter, 1) - 1
+}
+
+// evict brings the cache back under its byte budget. Evictions are
+// serialized, and each one compares the victims of all shards: the one with
+// the lowest rank leaves, the least recently used one among equal ranks.
+// Shards are locked one at a time, so the victim may change before it is
+// evicted, which only makes the order approximate under contention.
 func (this *Cache) evict() {
-	for i := this.l.Front(); i != nil && this.length > this.maxLength; i = i.Next() {
-		entry := this.l.Remove(i).(*Entry)
-		this.length -= len(entry.value)
-		delete(this.m, entry.key)
+	if atomic.LoadInt64(&this.length) <= int64(this.maxLength) {
+		return
+	}
+
+	this.evictMutex.Lock()
+	defer this.evictMutex.Unlock()
+
+	for atomic.LoadInt64(&this.length) > int64(this.maxLength) {
+		var best *shard
+		var bestRank float64
+		var bestAccessed int64
+		for _, shard := range this.shards {
+			rank, accessed, ok := shard.candidate()
+			if ok && (best == nil || rank < bestRank || rank == bestRank && accessed < bestAccessed) {
+				best, bestRank, bestAccessed = shard, rank, accessed
+			}
+		}
+
+		if best == nil {
+			return
+		}
+
+		best.evictOne()
+	}
+}
+
+func (this *Cache) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+			for _, shard := range this.shards {
+				// keep sampling while a noticeable share of the sample was expired
+				for shard.sweepSample() > sweepSampleSize/4 {
+				}
+			}
+		}
 	}
 }
@@ -4,24 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"net"
-	"sort"
 	"strconv"
 	"sync"
 	"time"
 )
 
 type Client struct {
-	addrs       []int
-	m           map[int]net.Addr
-	parser      *Parser
+	ring        *hashRing
+	m           map[string]net.Addr
 	connections map[string][]*net.Conn
 	mutex       sync.Mutex
 }
 
+// Item is a value returned by a retrieval command. Casid is only filled in
+// by «gets».
+type Item struct {
+	Value []byte
+	Flags uint64
+	Casid uint64
+}
+
 const (
 	pointCount              = 5
 	maxConnectionsPerServer = 10
@@ -30,8 +35,8 @@ const (
 
 func NewClient() *Client {
 	client := new(Client)
-	client.parser = new(Parser)
-	client.m = make(map[int]net.Addr)
+	client.ring = newHashRing(nil)
+	client.m = make(map[string]net.Addr)
 	client.connections = make(map[string][]*net.Conn)
 
 	return client
@@ -46,30 +51,85 @@ func (this *Client) AddServer(addr string) error {
 		return err
 	}
 
-	for i := 0; i < pointCount; i++ {
-		hash := int(crc32.ChecksumIEEE([]byte(addr + strconv.Itoa(i))))
-		this.addrs = append(this.addrs, hash)
-		this.m[hash] = address
+	this.ring.add(addr)
+	this.m[addr] = address
+
+	return nil
+}
+
+// FetchRing replaces the servers of the client with the current ring of the
+// cluster addr is a member of, so that keys go where the cluster keeps them.
+// Rings change as members join and leave, so it is worth fetching again
+// from time to time.
+func (this *Client) FetchRing(addr string) (err error) {
+	conn, err := net.DialTimeout("tcp", addr, connectionTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(connectionTimeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	if _, err = fmt.Fprintf(rw, "%s\r\n", cmdRing); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	parser := new(Parser)
+	m := make(map[string]net.Addr)
+	var members []string
+	for {
+		var line []byte
+		if line, err = rw.ReadSlice('\n'); err != nil {
+			return
+		}
+
+		if bytes.Equal(line, strEnd) {
+			break
+		}
+
+		if !bytes.HasPrefix(line, strMember) {
+			return fmt.Errorf("Unexpected response %q", line)
+		}
+
+		parser.cmd = bytes.Trim(line, "\r\n")
+		member, ok := parser.ParseRingResponse()
+		if !ok {
+			return fmt.Errorf("Cannot parse %s", parser.failedToken)
+		}
+
+		address, err := net.ResolveTCPAddr("tcp", string(member))
+		if err != nil {
+			return err
+		}
+
+		members = append(members, string(member))
+		m[string(member)] = address
 	}
 
-	sort.Ints(this.addrs)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.ring = newHashRing(members)
+	this.m = m
 
 	return nil
 }
 
 func (this *Client) getServerAddr(key []byte) net.Addr {
-	if len(this.addrs) == 0 {
-		return nil
-	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-	hash := int(crc32.ChecksumIEEE(key))
-	for _, h := range this.addrs {
-		if h > hash {
-			return this.m[h]
-		}
+	owner := this.ring.owner(key)
+	if owner == "" {
+		return nil
 	}
 
-	return this.m[this.addrs[0]]
+	return this.m[owner]
 }
 
 func (this *Client) getConnection(addr net.Addr) (conn *net.Conn, err error) {
@@ -96,14 +156,24 @@ func (this *Client) getConnection(addr net.Addr) (conn *net.Conn, err error) {
 	return conn, nil
 }
 
-func (this *Client) releaseConnection(addr net.Addr, conn *net.Conn) {
+// releaseConnection returns a connection to the pool once a command is
+// done with it. After an error the connection may be closed or left in the
+// middle of a response, so it is closed instead.
+func (this *Client) releaseConnection(addr net.Addr, conn *net.Conn, err error) {
+	if err != nil {
+		(*conn).Close()
+		return
+	}
+
 	this.mutex.Lock()
 	defer this.mutex.Unlock()
 
 	this.connections[addr.String()] = append(this.connections[addr.String()], conn)
 }
 
-func (this *Client) store(cmd []byte, key []byte, priority uint64, flags uint64, exptime uint64, casid uint64, value []byte) (err error) {
+// store sends a storage command; with noreply it returns as soon as the
+// command is written, without waiting for the server.
+func (this *Client) store(cmd []byte, key []byte, priority uint64, flags uint64, exptime uint64, casid uint64, value []byte, noreply bool) (err error) {
 	if err = this.validate(key, value); err != nil {
 		return
 	}
@@ -117,16 +187,21 @@ func (this *Client) store(cmd []byte, key []byte, priority uint64, flags uint64,
 	if err != nil {
 		return err
 	}
-	defer this.releaseConnection(addr, conn)
+	defer func() { this.releaseConnection(addr, conn, err) }()
 
 	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
 
+	var suffix []byte
+	if noreply {
+		suffix = tokenNoreply
+	}
+
 	if bytes.Equal(cmd, cmdCas) {
-		if _, err = fmt.Fprintf(rw, "%s %s %d %d %d %d %d \r\n", cmd, key, priority, flags, exptime, len(value), casid); err != nil {
+		if _, err = fmt.Fprintf(rw, "%s %s %d %d %d %d %d %s\r\n", cmd, key, priority, flags, exptime, len(value), casid, suffix); err != nil {
 			return
 		}
 	} else {
-		if _, err = fmt.Fprintf(rw, "%s %s %d %d %d %d \r\n", cmd, key, priority, flags, exptime, len(value)); err != nil {
+		if _, err = fmt.Fprintf(rw, "%s %s %d %d %d %d %s\r\n", cmd, key, priority, flags, exptime, len(value), suffix); err != nil {
 			return
 		}
 	}
@@ -135,7 +210,11 @@ func (this *Client) store(cmd []byte, key []byte, priority uint64, flags uint64,
 		return
 	}
 
-	if err = rw.Flush(); err != nil {
+	if _, err = rw.WriteString("\r\n"); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil || noreply {
 		return
 	}
 
@@ -158,30 +237,58 @@ func (this *Client) store(cmd []byte, key []byte, priority uint64, flags uint64,
 }
 
 func (this *Client) Set(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
-	return this.store(cmdSet, key, priority, flags, exptime, 0, value)
+	return this.store(cmdSet, key, priority, flags, exptime, 0, value, false)
 }
 
 func (this *Client) Add(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
-	return this.store(cmdAdd, key, priority, flags, exptime, 0, value)
+	return this.store(cmdAdd, key, priority, flags, exptime, 0, value, false)
 }
 
 func (this *Client) Replace(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
-	return this.store(cmdReplace, key, priority, flags, exptime, 0, value)
+	return this.store(cmdReplace, key, priority, flags, exptime, 0, value, false)
 }
 
 func (this *Client) Append(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
-	return this.store(cmdAppend, key, priority, flags, exptime, 0, value)
+	return this.store(cmdAppend, key, priority, flags, exptime, 0, value, false)
 }
 
 func (this *Client) Prepend(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
-	return this.store(cmdPrepend, key, priority, flags, exptime, 0, value)
+	return this.store(cmdPrepend, key, priority, flags, exptime, 0, value, false)
 }
 
 func (this *Client) Cas(key []byte, priority uint64, flags uint64, exptime uint64, casid uint64, value []byte) error {
-	return this.store(cmdCas, key, priority, flags, exptime, casid, value)
+	return this.store(cmdCas, key, priority, flags, exptime, casid, value, false)
+}
+
+// SetQuiet works like Set but does not wait for the server to reply, so
+// bulk loads are not bound by round-trip time. Errors reported by the server
+// are lost.
+func (this *Client) SetQuiet(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
+	return this.store(cmdSet, key, priority, flags, exptime, 0, value, true)
+}
+
+func (this *Client) AddQuiet(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
+	return this.store(cmdAdd, key, priority, flags, exptime, 0, value, true)
+}
+
+func (this *Client) ReplaceQuiet(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
+	return this.store(cmdReplace, key, priority, flags, exptime, 0, value, true)
+}
+
+func (this *Client) AppendQuiet(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
+	return this.store(cmdAppend, key, priority, flags, exptime, 0, value, true)
+}
+
+func (this *Client) PrependQuiet(key []byte, priority uint64, flags uint64, exptime uint64, value []byte) error {
+	return this.store(cmdPrepend, key, priority, flags, exptime, 0, value, true)
 }
 
-func (this *Client) get(cmd []byte, key []byte) (value []byte, flags uint64, casid uint64, err error) {
+func (this *Client) CasQuiet(key []byte, priority uint64, flags uint64, exptime uint64, casid uint64, value []byte) error {
+	return this.store(cmdCas, key, priority, flags, exptime, casid, value, true)
+}
+
+// get fetches a single key, args are sent between the command and the key.
+func (this *Client) get(cmd []byte, args [][]byte, key []byte) (value []byte, flags uint64, casid uint64, err error) {
 	if err = this.validate(key, nil); err != nil {
 		return
 	}
@@ -196,11 +303,22 @@ func (this *Client) get(cmd []byte, key []byte) (value []byte, flags uint64, cas
 	if err != nil {
 		return
 	}
-	defer this.releaseConnection(addr, conn)
+	defer func() { this.releaseConnection(addr, conn, err) }()
 
+	items, err := this.retrieve(conn, cmd, append(args, key))
+	if item, ok := items[string(key)]; ok {
+		return item.Value, item.Flags, item.Casid, err
+	}
+
+	return
+}
+
+// retrieve sends a single retrieval command with the arguments (the keys,
+// optionally preceded by an exptime) and reads VALUE blocks until END.
+func (this *Client) retrieve(conn *net.Conn, cmd []byte, args [][]byte) (items map[string]*Item, err error) {
 	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
 
-	if _, err = fmt.Fprintf(rw, "%s %s\r\n", cmd, key); err != nil {
+	if _, err = fmt.Fprintf(rw, "%s %s\r\n", cmd, bytes.Join(args, []byte(" "))); err != nil {
 		return
 	}
 
@@ -208,11 +326,14 @@ func (this *Client) get(cmd []byte, key []byte) (value []byte, flags uint64, cas
 		return
 	}
 
+	parser := new(Parser)
+	items = make(map[string]*Item)
 	for {
 		var line []byte
 		line, err = rw.ReadSlice('\n')
 		if err == io.EOF {
-			err = nil
+			// the server went away before END
+			err = io.ErrUnexpectedEOF
 			return
 		}
 		if err != nil {
@@ -223,35 +344,138 @@ func (this *Client) get(cmd []byte, key []byte) (value []byte, flags uint64, cas
 			return
 		}
 
-		this.parser.cmd = line
-		var size uint64
-		var ok bool
-		flags, size, casid, ok = this.parser.ParseGetResponse(cmd)
+		if bytes.HasPrefix(line, []byte("CLIENT_ERROR")) || bytes.HasPrefix(line, []byte("SERVER_ERROR")) {
+			err = fmt.Errorf("%s", bytes.Trim(line, "\r\n"))
+			return
+		}
 
+		parser.cmd = bytes.Trim(line, "\r\n")
+		key, flags, size, casid, ok := parser.ParseGetResponse(cmd)
 		if !ok {
-			err = fmt.Errorf("Cannot parse %s", this.parser.failedToken)
+			err = fmt.Errorf("Cannot parse %s", parser.failedToken)
 			return
 		}
 
+		var value []byte
 		value, err = ioutil.ReadAll(io.LimitReader(rw, int64(size)))
 		if err != nil {
 			return
 		}
 
-		return value, flags, casid, nil
+		if _, err = rw.Discard(len("\r\n")); err != nil {
+			return
+		}
+
+		items[string(key)] = &Item{Value: value, Flags: flags, Casid: casid}
 	}
 }
 
 func (this *Client) Get(key []byte) (value []byte, flags uint64, err error) {
-	value, flags, _, err = this.get(cmdGet, key)
+	value, flags, _, err = this.get(cmdGet, nil, key)
 	return
 }
 
 func (this *Client) Gets(key []byte) (value []byte, flags uint64, casid uint64, err error) {
-	return this.get(cmdGets, key)
+	return this.get(cmdGets, nil, key)
+}
+
+// GetAndTouch fetches a value and updates its expiry in one round trip.
+func (this *Client) GetAndTouch(key []byte, exptime uint64) (value []byte, flags uint64, err error) {
+	value, flags, _, err = this.get(cmdGat, [][]byte{[]byte(strconv.FormatUint(exptime, 10))}, key)
+	return
+}
+
+// GetMulti fetches all the keys with one «get» per server, querying the
+// servers in parallel. Keys which do not fit on one line are split over as
+// many «get» as needed. Missing keys are absent from the returned map.
+func (this *Client) GetMulti(keys [][]byte) (items map[string]*Item, err error) {
+	groups := make(map[string][][]byte)
+	addrs := make(map[string]net.Addr)
+	for _, key := range keys {
+		if err = this.validate(key, nil); err != nil {
+			return
+		}
+
+		addr := this.getServerAddr(key)
+		if addr == nil {
+			return nil, fmt.Errorf("No servers added")
+		}
+
+		groups[addr.String()] = append(groups[addr.String()], key)
+		addrs[addr.String()] = addr
+	}
+
+	type result struct {
+		items map[string]*Item
+		err   error
+	}
+
+	results := make(chan result, len(groups))
+	for name, group := range groups {
+		go func(addr net.Addr, group [][]byte) {
+			items, err := this.getBatches(addr, group)
+			results <- result{items: items, err: err}
+		}(addrs[name], group)
+	}
+
+	items = make(map[string]*Item)
+	for range groups {
+		r := <-results
+		if r.err != nil && err == nil {
+			err = r.err
+		}
+
+		for key, item := range r.items {
+			items[key] = item
+		}
+	}
+
+	return
+}
+
+// getBatches fetches keys of a single server, with as many «get» as it
+// takes to keep every line within the length servers read.
+func (this *Client) getBatches(addr net.Addr, keys [][]byte) (items map[string]*Item, err error) {
+	conn, err := this.getConnection(addr)
+	if err != nil {
+		return
+	}
+	defer func() { this.releaseConnection(addr, conn, err) }()
+
+	items = make(map[string]*Item)
+	for len(keys) > 0 {
+		length := len(cmdGet) + len("\r\n")
+		count := 0
+		for count < len(keys) && (count == 0 || length+1+len(keys[count]) <= maxLineLength) {
+			length += 1 + len(keys[count])
+			count++
+		}
+
+		var batch map[string]*Item
+		if batch, err = this.retrieve(conn, cmdGet, keys[:count]); err != nil {
+			return
+		}
+
+		for key, item := range batch {
+			items[key] = item
+		}
+
+		keys = keys[count:]
+	}
+
+	return
 }
 
 func (this *Client) Delete(key []byte) (err error) {
+	return this.delete(key, false)
+}
+
+// DeleteQuiet works like Delete but does not wait for the server to reply.
+func (this *Client) DeleteQuiet(key []byte) (err error) {
+	return this.delete(key, true)
+}
+
+func (this *Client) delete(key []byte, noreply bool) (err error) {
 	if err = this.validate(key, nil); err != nil {
 		return
 	}
@@ -265,15 +489,20 @@ func (this *Client) Delete(key []byte) (err error) {
 	if err != nil {
 		return
 	}
-	defer this.releaseConnection(addr, conn)
+	defer func() { this.releaseConnection(addr, conn, err) }()
 
 	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
 
-	if _, err = fmt.Fprintf(rw, "%s %s \r\n", cmdDelete, key); err != nil {
+	var suffix []byte
+	if noreply {
+		suffix = tokenNoreply
+	}
+
+	if _, err = fmt.Fprintf(rw, "%s %s %s\r\n", cmdDelete, key, suffix); err != nil {
 		return
 	}
 
-	if err = rw.Flush(); err != nil {
+	if err = rw.Flush(); err != nil || noreply {
 		return
 	}
 
@@ -291,8 +520,251 @@ func (this *Client) Delete(key []byte) (err error) {
 	return fmt.Errorf("Unextected response")
 }
 
+// Touch updates the expiry of a key without fetching its value.
+func (this *Client) Touch(key []byte, exptime uint64) (err error) {
+	if err = this.validate(key, nil); err != nil {
+		return
+	}
+
+	addr := this.getServerAddr(key)
+	if addr == nil {
+		return fmt.Errorf("No servers added")
+	}
+
+	conn, err := this.getConnection(addr)
+	if err != nil {
+		return
+	}
+	defer func() { this.releaseConnection(addr, conn, err) }()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
+
+	if _, err = fmt.Fprintf(rw, "%s %s %d\r\n", cmdTouch, key, exptime); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	line, err := rw.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	switch {
+	case bytes.Equal(line, []byte(msgTouched)):
+		return nil
+	case bytes.Equal(line, []byte(msgNotFound)):
+		return fmt.Errorf("Not found")
+	}
+
+	return fmt.Errorf("Unexpected response")
+}
+
+func (this *Client) arithmetic(cmd []byte, key []byte, delta uint64) (value uint64, err error) {
+	if err = this.validate(key, nil); err != nil {
+		return
+	}
+
+	addr := this.getServerAddr(key)
+	if addr == nil {
+		err = fmt.Errorf("No servers added")
+		return
+	}
+
+	conn, err := this.getConnection(addr)
+	if err != nil {
+		return
+	}
+	defer func() { this.releaseConnection(addr, conn, err) }()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
+
+	if _, err = fmt.Fprintf(rw, "%s %s %d\r\n", cmd, key, delta); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	line, err := rw.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	switch {
+	case bytes.Equal(line, []byte(msgNotFound)):
+		err = fmt.Errorf("Not found")
+		return
+	case bytes.HasPrefix(line, []byte("CLIENT_ERROR")):
+		err = fmt.Errorf("%s", bytes.Trim(line, "\r\n"))
+		return
+	}
+
+	value, err = strconv.ParseUint(string(bytes.Trim(line, "\r\n")), 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Unexpected response")
+	}
+
+	return
+}
+
+// Incr increments a numeric value and returns the new one.
+func (this *Client) Incr(key []byte, delta uint64) (value uint64, err error) {
+	return this.arithmetic(cmdIncr, key, delta)
+}
+
+// Decr decrements a numeric value, never going below zero, and returns the
+// new one.
+func (this *Client) Decr(key []byte, delta uint64) (value uint64, err error) {
+	return this.arithmetic(cmdDecr, key, delta)
+}
+
+// servers returns the distinct addresses registered through AddServer.
+func (this *Client) servers() (addrs []net.Addr) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, member := range this.ring.members() {
+		addrs = append(addrs, this.m[member])
+	}
+
+	return
+}
+
+func (this *Client) flushAll(addr net.Addr, delay uint64) (err error) {
+	conn, err := this.getConnection(addr)
+	if err != nil {
+		return
+	}
+	defer func() { this.releaseConnection(addr, conn, err) }()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
+
+	if _, err = fmt.Fprintf(rw, "%s %d\r\n", cmdFlush, delay); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	line, err := rw.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(line, []byte(msgOk)) {
+		return fmt.Errorf("Unexpected response")
+	}
+
+	return nil
+}
+
+// FlushAll invalidates every entry on every server, after delay seconds if
+// it is not zero.
+func (this *Client) FlushAll(delay uint64) (err error) {
+	addrs := this.servers()
+	if len(addrs) == 0 {
+		return fmt.Errorf("No servers added")
+	}
+
+	errs := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr net.Addr) {
+			errs <- this.flushAll(addr, delay)
+		}(addr)
+	}
+
+	for range addrs {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+func (this *Client) stats(addr net.Addr) (stats map[string]string, err error) {
+	conn, err := this.getConnection(addr)
+	if err != nil {
+		return
+	}
+	defer func() { this.releaseConnection(addr, conn, err) }()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
+
+	if _, err = fmt.Fprintf(rw, "%s\r\n", cmdStats); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	parser := new(Parser)
+	stats = make(map[string]string)
+	for {
+		var line []byte
+		line, err = rw.ReadSlice('\n')
+		if err != nil {
+			return
+		}
+
+		if bytes.Equal(line, strEnd) {
+			return
+		}
+
+		parser.cmd = bytes.Trim(line, "\r\n")
+		name, value, ok := parser.ParseStatResponse()
+		if !ok {
+			err = fmt.Errorf("Cannot parse %s", parser.failedToken)
+			return
+		}
+
+		stats[string(name)] = string(value)
+	}
+}
+
+// Stats collects the «stats» output of every server, keyed by server
+// address.
+func (this *Client) Stats() (stats map[string]map[string]string, err error) {
+	addrs := this.servers()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No servers added")
+	}
+
+	type result struct {
+		addr  net.Addr
+		stats map[string]string
+		err   error
+	}
+
+	results := make(chan result, len(addrs))
+	for _, addr := range addrs {
+		go func(addr net.Addr) {
+			stats, err := this.stats(addr)
+			results <- result{addr: addr, stats: stats, err: err}
+		}(addr)
+	}
+
+	stats = make(map[string]map[string]string)
+	for range addrs {
+		r := <-results
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+
+		stats[r.addr.String()] = r.stats
+	}
+
+	return
+}
+
 func (this *Client) validate(key []byte, value []byte) (err error) {
-	if len(key) == 0 || len(key) > maxKeyLength {
+	if len(key) == 0 || validateKey(key, maxKeyLength) != "" {
 		return fmt.Errorf("Invalid key")
 	}
 
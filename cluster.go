@@ -0,0 +1,592 @@
+package whatever
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster members find each other by gossip: every gossipInterval a member
+// bumps its own heartbeat and swaps the list of members it knows with a
+// random one, keeping the highest heartbeat it hears of for each of them. A
+// member whose heartbeat stops advancing for memberTimeout, or which says it
+// left, drops out of the ring, which is the one clients use. Whenever the
+// ring changes, every member hands the keys it no longer owns over to their
+// new owners in the background.
+const (
+	gossipInterval = 200 * time.Millisecond
+	gossipTimeout  = time.Second
+	memberTimeout  = 3 * time.Second
+	// members which are gone are remembered for a while, so that a late
+	// gossip about them is not taken for news
+	memberForget = time.Minute
+
+	// keys are handed over in «migrate» batches of about this many bytes,
+	// counting every entry as its key, its value and this much encoding
+	migrationBatch         = 1024 * 1024
+	migrationEntryOverhead = 64
+	// batches go over migrationBatch by their last entry, whose key and
+	// encoding fit in this much besides its value
+	migrationMargin = 64 * 1024
+	migrationRetry  = time.Second
+
+	memberAlive = "alive"
+	memberLeft  = "left"
+)
+
+func init() {
+	// members gossip several times a second
+	registerCommand(&command{name: string(cmdGossip), minArgs: 0, maxArgs: -1, parse: (*Parser).parseGossipCmd, execute: (*session).runGossipCmd, quiet: true})
+	registerCommand(&command{name: string(cmdRing), minArgs: 0, maxArgs: 0, execute: (*session).runRingCmd})
+	registerCommand(&command{name: string(cmdMigrate), minArgs: 1, maxArgs: 1, parse: (*Parser).parseMigrateCmd, execute: (*session).runMigrateCmd})
+}
+
+// memberDigest is what members gossip about each other.
+type memberDigest struct {
+	addr      string
+	heartbeat uint64
+	left      bool
+}
+
+type member struct {
+	heartbeat uint64
+	left      bool
+	seen      time.Time
+}
+
+type cluster struct {
+	server *Server
+	self   string
+	seeds  []string
+
+	mutex   sync.Mutex
+	members map[string]*member
+	alive   []string
+	ring    *hashRing
+
+	changed        chan struct{}
+	migrationMutex sync.Mutex
+	migrated       uint64
+	adopted        uint64
+}
+
+// JoinCluster makes the server a member of the cluster the seeds belong to,
+// announcing itself as advertise, the address of the server if empty, which
+// the other members must be able to reach. A server without seeds starts a
+// cluster of its own.
+func (this *Server) JoinCluster(advertise string, seeds ...string) {
+	if advertise == "" {
+		advertise = this.addr
+	}
+
+	cluster := &cluster{
+		server:  this,
+		self:    advertise,
+		seeds:   seeds,
+		members: make(map[string]*member),
+		changed: make(chan struct{}, 1),
+	}
+	// starting from the clock makes the heartbeats of a restarted member
+	// newer than those of its previous life
+	cluster.members[advertise] = &member{heartbeat: uint64(time.Now().UnixNano()), seen: time.Now()}
+	cluster.update()
+
+	this.cluster = cluster
+	go cluster.gossip()
+	go cluster.rebalance()
+}
+
+// LeaveCluster announces that the server leaves the cluster and hands all
+// its keys over to the remaining members.
+func (this *Server) LeaveCluster() error {
+	cluster := this.cluster
+	if cluster == nil {
+		return errors.New("Not in a cluster")
+	}
+
+	cluster.mutex.Lock()
+	self := cluster.members[cluster.self]
+	self.left = true
+	self.heartbeat++
+	cluster.update()
+	peers := cluster.peers()
+	cluster.mutex.Unlock()
+
+	log.Printf("Leaving cluster of %d members", len(peers)+1)
+
+	// every peer hears of it right away, so that they stop routing keys here
+	for _, peer := range peers {
+		if err := cluster.exchange(peer); err != nil {
+			log.Printf("Cannot tell %s about leaving: %s", peer, err)
+		}
+	}
+
+	if !cluster.migrate() {
+		return errors.New("Cannot hand every key over")
+	}
+
+	return nil
+}
+
+func (this *cluster) gossip() {
+	ticker := time.NewTicker(gossipInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.server.done:
+			return
+		case <-ticker.C:
+		}
+
+		this.mutex.Lock()
+		this.members[this.self].heartbeat++
+		this.members[this.self].seen = time.Now()
+		this.update()
+		peers := this.peers()
+		this.mutex.Unlock()
+
+		// seeds are only needed until some member is known
+		if len(peers) == 0 {
+			peers = this.seeds
+		}
+
+		if len(peers) == 0 {
+			continue
+		}
+
+		peer := peers[rand.Intn(len(peers))]
+		if err := this.exchange(peer); err != nil {
+			log.Printf("Cannot gossip with %s: %s", peer, err)
+		}
+	}
+}
+
+// exchange sends the members this one knows to peer and merges those peer
+// knows.
+func (this *cluster) exchange(peer string) (err error) {
+	conn, err := net.DialTimeout("tcp", peer, gossipTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(gossipTimeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	if _, err = fmt.Fprintf(rw, "%s%s\r\n", cmdGossip, this.digest()); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	line, err := rw.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+
+	if !bytes.HasPrefix(line, strMembers) {
+		return fmt.Errorf("Unexpected response %q", line)
+	}
+
+	parser := &Parser{cmd: bytes.Trim(line, "\r\n")}
+	members, ok := parser.ParseGossipResponse()
+	if !ok {
+		return fmt.Errorf("Cannot parse %s", parser.failedToken)
+	}
+
+	this.merge(members)
+	return
+}
+
+// digest lists the members worth telling about, each preceded by a space:
+// those which were not heard of for memberTimeout are left out, so that no
+// member brings back one the others have given up on.
+func (this *cluster) digest() []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var digest bytes.Buffer
+	for addr, member := range this.members {
+		if time.Since(member.seen) >= memberTimeout {
+			continue
+		}
+
+		state := memberAlive
+		if member.left {
+			state = memberLeft
+		}
+		fmt.Fprintf(&digest, " %s %d %s", addr, member.heartbeat, state)
+	}
+
+	return digest.Bytes()
+}
+
+func (this *cluster) merge(members []memberDigest) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, digest := range members {
+		known, found := this.members[digest.addr]
+		if digest.addr == this.self {
+			// someone remembers a newer life of this member, which must
+			// outlive it
+			if digest.heartbeat >= known.heartbeat {
+				known.heartbeat = digest.heartbeat + 1
+			}
+			continue
+		}
+
+		if !found {
+			log.Printf("Member %s joined", digest.addr)
+			this.members[digest.addr] = &member{heartbeat: digest.heartbeat, left: digest.left, seen: time.Now()}
+		} else if digest.heartbeat > known.heartbeat {
+			if digest.left && !known.left {
+				log.Printf("Member %s left", digest.addr)
+			}
+			known.heartbeat = digest.heartbeat
+			known.left = digest.left
+			known.seen = time.Now()
+		}
+	}
+
+	this.update()
+}
+
+// update forgets long gone members and rebuilds the ring from those which
+// are alive, asking for a rebalance if it changed. The caller holds the
+// mutex.
+func (this *cluster) update() {
+	var alive []string
+	for addr, member := range this.members {
+		since := time.Since(member.seen)
+		if addr != this.self && since >= memberForget {
+			delete(this.members, addr)
+		} else if !member.left && (addr == this.self || since < memberTimeout) {
+			alive = append(alive, addr)
+		}
+	}
+	sort.Strings(alive)
+
+	if this.ring != nil && equalMembers(alive, this.alive) {
+		return
+	}
+
+	log.Printf("Cluster ring changed to %v", alive)
+	this.alive = alive
+	this.ring = newHashRing(alive)
+
+	select {
+	case this.changed <- struct{}{}:
+	default:
+	}
+}
+
+func equalMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// peers returns the other members of the ring. The caller holds the mutex.
+func (this *cluster) peers() (peers []string) {
+	for _, addr := range this.alive {
+		if addr != this.self {
+			peers = append(peers, addr)
+		}
+	}
+
+	return
+}
+
+func (this *cluster) currentRing() *hashRing {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	return this.ring
+}
+
+// rebalance migrates keys whenever the ring changes, retrying until every
+// key has reached its owner.
+func (this *cluster) rebalance() {
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-this.server.done:
+			return
+		case <-this.changed:
+		case <-retry:
+		}
+
+		retry = nil
+		if !this.migrate() {
+			retry = time.After(migrationRetry)
+		}
+	}
+}
+
+// migrate hands every key this member does not own over to its owner,
+// reporting whether all of them made it.
+func (this *cluster) migrate() (ok bool) {
+	this.migrationMutex.Lock()
+	defer this.migrationMutex.Unlock()
+
+	ok = true
+	ring := this.currentRing()
+	for _, owner := range ring.members() {
+		if owner == this.self {
+			continue
+		}
+
+		if err := this.migrateTo(ring, owner); err != nil {
+			log.Printf("Cannot migrate keys to %s: %s", owner, err)
+			ok = false
+		}
+	}
+
+	return
+}
+
+// migrateTo sends the keys owner has in ring in batches, deleting each key
+// once it made it unless it changed in the meantime, in which case it is
+// sent again on the retry. The keys are listed once, a shard at a time, and
+// only read again batch by batch, so that traffic is never held up for
+// longer than a shard scan.
+func (this *cluster) migrateTo(ring *hashRing, owner string) (err error) {
+	cache := this.server.cache
+	keys := cache.keys(func(key string) bool {
+		return ring.owner([]byte(key)) == owner
+	})
+
+	changed := 0
+	for len(keys) > 0 {
+		var batch []Entry
+		var size int
+		for ; len(keys) > 0 && size < migrationBatch; keys = keys[1:] {
+			if entry, ok := cache.Peek(keys[0]); ok {
+				batch = append(batch, entry)
+				size += len(entry.key) + len(entry.value) + migrationEntryOverhead
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var snapshot bytes.Buffer
+		if err = writeSnapshot(&snapshot, batch, atomic.LoadUint64(&cache.counter)); err != nil {
+			return
+		}
+
+		if err = sendMigration(owner, snapshot.Bytes()); err != nil {
+			return
+		}
+
+		for _, entry := range batch {
+			if _, ok := cache.CheckAndDelete(entry.key, entry.casid); !ok {
+				changed++
+			}
+		}
+		atomic.AddUint64(&this.migrated, uint64(len(batch)))
+		log.Printf("Migrated %d keys to %s", len(batch), owner)
+	}
+
+	if changed > 0 {
+		err = fmt.Errorf("%d keys changed while migrating", changed)
+	}
+
+	return
+}
+
+// keys lists the keys keep accepts, locking one shard at a time.
+func (this *Cache) keys(keep func(key string) bool) (keys []string) {
+	for _, shard := range this.shards {
+		shard.mutex.Lock()
+		for key := range shard.m {
+			if keep(key) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	return
+}
+
+func sendMigration(owner string, snapshot []byte) (err error) {
+	conn, err := net.DialTimeout("tcp", owner, gossipTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if _, err = fmt.Fprintf(rw, "%s %d\r\n", cmdMigrate, len(snapshot)); err != nil {
+		return
+	}
+
+	if _, err = rw.Write(snapshot); err != nil {
+		return
+	}
+
+	if _, err = rw.WriteString("\r\n"); err != nil {
+		return
+	}
+
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	line, err := rw.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(line, []byte(msgOk)) {
+		return fmt.Errorf("Unexpected response %q", line)
+	}
+
+	return
+}
+
+// adopt stores the entries migrated from another member, counter being the
+// casid counter of that member. The counter of the cache continues from it,
+// so that casids of both members compare: a key which is already stored
+// keeps whichever copy has the newer casid, as the key may have changed on
+// either member since it was first sent.
+func (this *Cache) adopt(entries []*Entry, counter uint64) (count int) {
+	defer this.evict()
+
+	this.continueCounter(counter)
+
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		if !entry.expired(now) && this.shard(entry.key).adopt(entry) {
+			count++
+		}
+	}
+
+	return
+}
+
+// adopt stores a migrated entry with its casid, unless the stored copy is
+// newer.
+func (this *shard) adopt(entry *Entry) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if stored, found := this.lookup(entry.key); found {
+		if stored.casid >= entry.casid {
+			return false
+		}
+		this.remove(stored)
+	}
+
+	casid := entry.casid
+	this.insert(entry)
+	entry.casid = casid
+	this.record(journalStore, entry)
+	return true
+}
+
+func (this *session) runGossipCmd(request *textRequest) {
+	cluster := this.server.cluster
+	if cluster == nil {
+		this.handleServerError("Not in a cluster")
+		return
+	}
+
+	cluster.merge(request.members)
+	fmt.Fprintf(&this.response, "%s%s\r\n", strMembers, cluster.digest())
+}
+
+func (this *session) runRingCmd(request *textRequest) {
+	cluster := this.server.cluster
+	if cluster == nil {
+		this.handleServerError("Not in a cluster")
+		return
+	}
+
+	for _, addr := range cluster.currentRing().members() {
+		fmt.Fprintf(&this.response, "%s %s\r\n", strMember, addr)
+	}
+	this.response.Write(strEnd)
+}
+
+func (this *session) runMigrateCmd(request *textRequest) {
+	cluster := this.server.cluster
+	if cluster == nil {
+		this.skipData(request.size)
+		this.handleServerError("Not in a cluster")
+		return
+	}
+
+	// batches are bound by the value limit of the entry which takes them
+	// over migrationBatch
+	if request.size > uint64(migrationBatch+this.server.maxValueLength+migrationMargin) {
+		log.Printf("Rejected migration batch of %d bytes", request.size)
+		this.rejectData(request.size, "Migration batch too large")
+		return
+	}
+
+	data, err := this.readValue(request.size)
+	if err != nil || !this.readTerminator() {
+		return
+	}
+
+	if this.readOnly() {
+		return
+	}
+
+	entries, counter, err := readSnapshot(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Cannot read migrated keys: %s", err)
+		this.handleInputError(err.Error())
+		return
+	}
+
+	count := this.server.cache.adopt(entries, counter)
+	atomic.AddUint64(&cluster.adopted, uint64(count))
+	log.Printf("Adopted %d of %d migrated keys from %s", count, len(entries), this.conn.RemoteAddr())
+
+	this.response.WriteString(msgOk)
+}
+
+// clusterStats reports the membership of the server and how many keys it
+// handed over and took in.
+func (this *Server) clusterStats() []stat {
+	cluster := this.cluster
+	if cluster == nil {
+		return []stat{{"cluster_enabled", 0}}
+	}
+
+	cluster.mutex.Lock()
+	members := len(cluster.alive)
+	cluster.mutex.Unlock()
+
+	return []stat{
+		{"cluster_enabled", 1},
+		{"cluster_self", cluster.self},
+		{"cluster_members", members},
+		{"cluster_migrated_items", atomic.LoadUint64(&cluster.migrated)},
+		{"cluster_adopted_items", atomic.LoadUint64(&cluster.adopted)},
+	}
+}
@@ -0,0 +1,125 @@
+package whatever
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// command is an entry of the text protocol registry: the session looks the
+// first token of every line up by name, checks the number of arguments
+// which follow it, parses them and executes the command with them.
+type command struct {
+	name string
+	// minArgs and maxArgs bound the number of arguments, maxArgs < 0
+	// meaning that there is no upper bound
+	minArgs int
+	maxArgs int
+	// parse reads the arguments into the request, setting failedToken if it
+	// cannot; commands without arguments have none
+	parse   func(parser *Parser, request *textRequest) bool
+	execute func(this *session, request *textRequest)
+	// quiet commands are not logged, being too frequent
+	quiet bool
+	// final commands take the connection over, so the session ends with them
+	final bool
+}
+
+// textRequest holds the arguments of a text protocol command, each command
+// using the fields it has arguments for.
+type textRequest struct {
+	key      []byte
+	keys     [][]byte
+	priority uint64
+	flags    uint64
+	exptime  uint64
+	size     uint64
+	casid    uint64
+	delta    uint64
+	delay    uint64
+	noreply  bool
+	group    []byte
+	meta     []metaFlag
+	members  []memberDigest
+}
+
+var commands = make(map[string]*command)
+
+// registerCommand adds a command to the registry, which is only done from
+// init functions.
+func registerCommand(cmd *command) {
+	if _, found := commands[cmd.name]; found {
+		panic("Command «" + cmd.name + "» registered twice")
+	}
+
+	commands[cmd.name] = cmd
+}
+
+func init() {
+	for _, cmd := range []*command{
+		{name: string(cmdSet), minArgs: 5, maxArgs: 6, parse: (*Parser).parseStoreCmd, execute: (*session).runSetCmd},
+		{name: string(cmdAdd), minArgs: 5, maxArgs: 6, parse: (*Parser).parseStoreCmd, execute: (*session).runAddCmd},
+		{name: string(cmdReplace), minArgs: 5, maxArgs: 6, parse: (*Parser).parseStoreCmd, execute: (*session).runReplaceCmd},
+		{name: string(cmdAppend), minArgs: 5, maxArgs: 6, parse: (*Parser).parseStoreCmd, execute: (*session).runAppendCmd},
+		{name: string(cmdPrepend), minArgs: 5, maxArgs: 6, parse: (*Parser).parseStoreCmd, execute: (*session).runPrependCmd},
+		{name: string(cmdCas), minArgs: 6, maxArgs: 7, parse: (*Parser).parseCasCmd, execute: (*session).runCasCmd},
+		{name: string(cmdGet), minArgs: 1, maxArgs: -1, parse: (*Parser).parseRetrievalCmd, execute: (*session).runGetCmd},
+		{name: string(cmdGets), minArgs: 1, maxArgs: -1, parse: (*Parser).parseRetrievalCmd, execute: (*session).runGetsCmd},
+		{name: string(cmdGat), minArgs: 2, maxArgs: -1, parse: (*Parser).parseTouchingRetrievalCmd, execute: (*session).runGatCmd},
+		{name: string(cmdGats), minArgs: 2, maxArgs: -1, parse: (*Parser).parseTouchingRetrievalCmd, execute: (*session).runGatsCmd},
+		{name: string(cmdTouch), minArgs: 2, maxArgs: 2, parse: (*Parser).parseTouchCmd, execute: (*session).runTouchCmd},
+		{name: string(cmdDelete), minArgs: 1, maxArgs: 2, parse: (*Parser).parseDeleteCmd, execute: (*session).runDeleteCmd},
+		{name: string(cmdIncr), minArgs: 2, maxArgs: 2, parse: (*Parser).parseArithmeticCmd, execute: (*session).runIncrCmd},
+		{name: string(cmdDecr), minArgs: 2, maxArgs: 2, parse: (*Parser).parseArithmeticCmd, execute: (*session).runDecrCmd},
+		{name: string(cmdFlush), minArgs: 0, maxArgs: 2, parse: (*Parser).parseFlushAllCmd, execute: (*session).runFlushAllCmd},
+		{name: string(cmdStats), minArgs: 0, maxArgs: 1, parse: (*Parser).parseStatsCmd, execute: (*session).runStatsCmd},
+		{name: string(cmdSave), minArgs: 0, maxArgs: 0, execute: (*session).runSaveCmd},
+
+		{name: string(cmdMetaGet), minArgs: 1, maxArgs: -1, parse: (*Parser).parseMetaCmd, execute: (*session).runMetaGetCmd},
+		{name: string(cmdMetaSet), minArgs: 2, maxArgs: -1, parse: (*Parser).parseMetaSetCmd, execute: (*session).runMetaSetCmd},
+		{name: string(cmdMetaDelete), minArgs: 1, maxArgs: -1, parse: (*Parser).parseMetaCmd, execute: (*session).runMetaDeleteCmd},
+		{name: string(cmdMetaArithmetic), minArgs: 1, maxArgs: -1, parse: (*Parser).parseMetaCmd, execute: (*session).runMetaArithmeticCmd},
+		{name: string(cmdMetaNoop), minArgs: 0, maxArgs: 0, execute: (*session).runMetaNoopCmd},
+	} {
+		registerCommand(cmd)
+	}
+}
+
+// dispatch runs the command of the current line, reporting whether the
+// session goes on. Unknown commands are answered with ERROR.
+func (this *session) dispatch() bool {
+	// the name starts the line, the parser is left right after it
+	name := this.parser.cmd
+	if space := bytes.IndexByte(name, ' '); space != -1 {
+		name = name[:space]
+	}
+	this.parser.position = len(name)
+
+	cmd, found := commands[string(name)]
+	if !found {
+		log.Printf("Received nonexistent command «%s»", this.parser.cmd)
+		this.handleError()
+		return true
+	}
+
+	args := this.parser.countTokens()
+	if args < cmd.minArgs || cmd.maxArgs >= 0 && args > cmd.maxArgs {
+		log.Printf("Received «%s» command with %d arguments: %s", cmd.name, args, this.parser.cmd)
+		this.handleInputError("Wrong number of arguments")
+		return true
+	}
+
+	if !cmd.quiet {
+		log.Printf("Received «%s» command: %s", cmd.name, this.parser.cmd)
+	}
+
+	var request textRequest
+	if cmd.parse != nil && !cmd.parse(this.parser, &request) {
+		log.Printf("An error occured while parsing «%s» command: cannot parse %s", cmd.name, this.parser.failedToken)
+		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
+		return true
+	}
+
+	cmd.execute(this, &request)
+	return !cmd.final
+}
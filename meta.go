@@ -0,0 +1,369 @@
+package whatever
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Flags accepted by each meta command. Besides the standard memcached ones,
+// «p» returns the priority of an entry and «P<priority>» sets it.
+const (
+	metaGetFlags        = "cfhklOpqstTv"
+	metaSetFlags        = "cCFkMOPqT"
+	metaDeleteFlags     = "CkOq"
+	metaArithmeticFlags = "cDJkMNOqtTv"
+)
+
+func findMetaFlag(flags []metaFlag, name byte) (token []byte, ok bool) {
+	for _, flag := range flags {
+		if flag.name == name {
+			return flag.token, true
+		}
+	}
+
+	return
+}
+
+// parseMetaUint64 reads the numeric token of a flag, returning def if the
+// flag is absent.
+func parseMetaUint64(flags []metaFlag, name byte, def uint64) (value uint64, ok bool) {
+	token, found := findMetaFlag(flags, name)
+	if !found {
+		return def, true
+	}
+
+	return parseUint64(token)
+}
+
+func validateMetaFlags(flags []metaFlag, allowed string) bool {
+	for _, flag := range flags {
+		if bytes.IndexByte([]byte(allowed), flag.name) == -1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeMetaReturnFlags echoes the requested return flags in request order.
+// Entry flags are skipped when there is no entry to report on.
+func (this *session) writeMetaReturnFlags(flags []metaFlag, key []byte, entry *Entry) {
+	now := time.Now().UnixNano()
+
+	for _, flag := range flags {
+		switch flag.name {
+		case 'O':
+			fmt.Fprintf(&this.response, " O%s", flag.token)
+		case 'k':
+			fmt.Fprintf(&this.response, " k%s", key)
+		}
+
+		if entry == nil {
+			continue
+		}
+
+		switch flag.name {
+		case 'c':
+			fmt.Fprintf(&this.response, " c%d", entry.casid)
+		case 'f':
+			fmt.Fprintf(&this.response, " f%d", entry.flags)
+		case 's':
+			fmt.Fprintf(&this.response, " s%d", len(entry.value))
+		case 'p':
+			fmt.Fprintf(&this.response, " p%d", entry.priority)
+		case 't':
+			ttl := int64(-1)
+			if entry.expires != 0 {
+				ttl = (entry.expires - now + int64(time.Second) - 1) / int64(time.Second)
+			}
+			fmt.Fprintf(&this.response, " t%d", ttl)
+		case 'h':
+			if entry.fetched {
+				this.response.WriteString(" h1")
+			} else {
+				this.response.WriteString(" h0")
+			}
+		case 'l':
+			fmt.Fprintf(&this.response, " l%d", (now-entry.accessed)/int64(time.Second))
+		}
+	}
+}
+
+func (this *session) writeMetaStatus(status string, flags []metaFlag, key []byte, entry *Entry) {
+	this.response.WriteString(status)
+	this.writeMetaReturnFlags(flags, key, entry)
+	this.response.WriteString("\r\n")
+}
+
+func (this *session) runMetaGetCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
+		return
+	}
+
+	if !validateMetaFlags(request.meta, metaGetFlags) {
+		this.handleInputError("Invalid flag")
+		return
+	}
+
+	_, touch := findMetaFlag(request.meta, 'T')
+	exptime, ok := parseMetaUint64(request.meta, 'T', 0)
+	if !ok {
+		this.handleInputError("Bad token in command line format")
+		return
+	}
+
+	log.Printf("Parsed «mg» command arguments: key=\"%s\", flags=\"%s\"", request.key, this.parser.cmd[len(cmdMetaGet):])
+
+	if touch && this.readOnly() {
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdGet, 1)
+	if touch {
+		atomic.AddUint64(&this.server.stats.cmdTouch, 1)
+	}
+
+	entry, ok := this.server.cache.MetaGet(string(request.key[:]), touch, exptime)
+	if !ok {
+		atomic.AddUint64(&this.server.stats.getMisses, 1)
+		log.Printf("Cache miss for key=\"%s\"", request.key)
+		if _, quiet := findMetaFlag(request.meta, 'q'); !quiet {
+			this.response.WriteString(msgMetaMiss)
+		}
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.getHits, 1)
+	log.Printf("Retrieved value=\"%s\" for key=\"%s\"", entry.value, request.key)
+
+	if _, value := findMetaFlag(request.meta, 'v'); value {
+		fmt.Fprintf(&this.response, "%s %d", msgMetaValue, len(entry.value))
+		this.writeMetaReturnFlags(request.meta, request.key, &entry)
+		this.response.WriteString("\r\n")
+		this.response.Write(entry.value)
+		this.response.WriteString("\r\n")
+	} else {
+		this.writeMetaStatus(msgMetaHit, request.meta, request.key, &entry)
+	}
+}
+
+func (this *session) runMetaSetCmd(request *textRequest) {
+	value, ok := this.readData(request.key, request.size)
+	if !ok {
+		return
+	}
+
+	if !validateMetaFlags(request.meta, metaSetFlags) {
+		this.handleInputError("Invalid flag")
+		return
+	}
+
+	priority, ok1 := parseMetaUint64(request.meta, 'P', 0)
+	clientFlags, ok2 := parseMetaUint64(request.meta, 'F', 0)
+	exptime, ok3 := parseMetaUint64(request.meta, 'T', 0)
+	casid, ok4 := parseMetaUint64(request.meta, 'C', 0)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		this.handleInputError("Bad token in command line format")
+		return
+	}
+
+	mode := byte('S')
+	if token, ok := findMetaFlag(request.meta, 'M'); ok {
+		if len(token) != 1 {
+			this.handleInputError("Invalid mode for ms")
+			return
+		}
+		mode = bytes.ToUpper(token)[0]
+	}
+
+	_, compare := findMetaFlag(request.meta, 'C')
+	if compare && mode != 'S' && mode != 'R' {
+		this.handleInputError("Compare and swap is only supported in set and replace modes")
+		return
+	}
+
+	log.Printf("Parsed «ms» command arguments: key=\"%s\", value=\"%s\", flags=\"%s\"", request.key, value, this.parser.cmd[len(cmdMetaSet):])
+
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+
+	if this.readOnly() {
+		return
+	}
+
+	cache := this.server.cache
+	var stored Entry
+	status := msgMetaHit
+	switch {
+	case compare:
+		if entry, ok := cache.CheckAndStore(string(request.key[:]), value, priority, clientFlags, exptime, casid); ok {
+			stored = *entry
+		} else if entry == nil {
+			status = msgMetaNotFound
+		} else {
+			status = msgMetaExists
+		}
+	case mode == 'S':
+		stored, ok = cache.Set(string(request.key[:]), value, priority, clientFlags, exptime)
+	case mode == 'E':
+		stored, ok = cache.Add(string(request.key[:]), value, priority, clientFlags, exptime)
+	case mode == 'R':
+		stored, ok = cache.Replace(string(request.key[:]), value, priority, clientFlags, exptime)
+	case mode == 'A':
+		stored, ok = cache.Append(string(request.key[:]), value, priority, clientFlags, exptime)
+	case mode == 'P':
+		stored, ok = cache.Prepend(string(request.key[:]), value, priority, clientFlags, exptime)
+	default:
+		this.handleInputError("Invalid mode for ms")
+		return
+	}
+
+	if !ok {
+		status = msgMetaNotStored
+	}
+
+	if status != msgMetaHit {
+		this.writeMetaStatus(status, request.meta, request.key, nil)
+		return
+	}
+
+	if _, quiet := findMetaFlag(request.meta, 'q'); quiet {
+		return
+	}
+
+	// the entry as this command stored it, even if it has changed since
+	this.writeMetaStatus(msgMetaHit, request.meta, request.key, &stored)
+}
+
+func (this *session) runMetaDeleteCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
+		return
+	}
+
+	if !validateMetaFlags(request.meta, metaDeleteFlags) {
+		this.handleInputError("Invalid flag")
+		return
+	}
+
+	casid, ok := parseMetaUint64(request.meta, 'C', 0)
+	if !ok {
+		this.handleInputError("Bad token in command line format")
+		return
+	}
+
+	log.Printf("Parsed «md» command arguments: key=\"%s\", flags=\"%s\"", request.key, this.parser.cmd[len(cmdMetaDelete):])
+
+	if this.readOnly() {
+		return
+	}
+
+	status := msgMetaHit
+	if _, compare := findMetaFlag(request.meta, 'C'); compare {
+		if entry, ok := this.server.cache.CheckAndDelete(string(request.key[:]), casid); !ok {
+			if entry == nil {
+				status = msgMetaNotFound
+			} else {
+				status = msgMetaExists
+			}
+		}
+	} else if !this.server.cache.Delete(string(request.key[:])) {
+		status = msgMetaNotFound
+	}
+
+	if _, quiet := findMetaFlag(request.meta, 'q'); quiet && status != msgMetaExists {
+		return
+	}
+
+	this.writeMetaStatus(status, request.meta, request.key, nil)
+}
+
+func (this *session) runMetaArithmeticCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
+		return
+	}
+
+	if !validateMetaFlags(request.meta, metaArithmeticFlags) {
+		this.handleInputError("Invalid flag")
+		return
+	}
+
+	delta, ok1 := parseMetaUint64(request.meta, 'D', 1)
+	initial, ok2 := parseMetaUint64(request.meta, 'J', 0)
+	vivify, ok3 := parseMetaUint64(request.meta, 'N', 0)
+	exptime, ok4 := parseMetaUint64(request.meta, 'T', 0)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		this.handleInputError("Bad token in command line format")
+		return
+	}
+
+	decrement := false
+	if token, ok := findMetaFlag(request.meta, 'M'); ok {
+		switch string(token) {
+		case "I", "i", "+":
+		case "D", "d", "-":
+			decrement = true
+		default:
+			this.handleInputError("Invalid mode for ma")
+			return
+		}
+	}
+
+	log.Printf("Parsed «ma» command arguments: key=\"%s\", flags=\"%s\"", request.key, this.parser.cmd[len(cmdMetaArithmetic):])
+
+	if this.readOnly() {
+		return
+	}
+
+	cache := this.server.cache
+	var entry *Entry
+	var value uint64
+	var ok bool
+	if decrement {
+		entry, value, ok = cache.Decr(string(request.key[:]), delta)
+	} else {
+		entry, value, ok = cache.Incr(string(request.key[:]), delta)
+	}
+
+	_, quiet := findMetaFlag(request.meta, 'q')
+
+	if entry == nil {
+		if _, autovivify := findMetaFlag(request.meta, 'N'); !autovivify {
+			if !quiet {
+				this.writeMetaStatus(msgMetaNotFound, request.meta, request.key, nil)
+			}
+			return
+		}
+
+		value = initial
+		stored, ok := cache.Add(string(request.key[:]), []byte(strconv.FormatUint(initial, 10)), 0, 0, vivify)
+		if !ok {
+			this.writeMetaStatus(msgMetaNotStored, request.meta, request.key, nil)
+			return
+		}
+		entry = &stored
+	} else if !ok {
+		log.Printf("Cannot update non-numeric value for key=\"%s\"", request.key)
+		this.handleInputError(errNonNumeric)
+		return
+	} else if _, touch := findMetaFlag(request.meta, 'T'); touch && cache.Touch(string(request.key[:]), exptime) {
+		entry.expires = expiration(exptime)
+	}
+
+	if _, withValue := findMetaFlag(request.meta, 'v'); withValue {
+		number := strconv.FormatUint(value, 10)
+		fmt.Fprintf(&this.response, "%s %d", msgMetaValue, len(number))
+		this.writeMetaReturnFlags(request.meta, request.key, entry)
+		this.response.WriteString("\r\n")
+		this.response.WriteString(number)
+		this.response.WriteString("\r\n")
+	} else if !quiet {
+		this.writeMetaStatus(msgMetaHit, request.meta, request.key, entry)
+	}
+}
+
+func (this *session) runMetaNoopCmd(request *textRequest) {
+	this.response.WriteString(msgMetaNoop)
+}
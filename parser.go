@@ -15,31 +15,98 @@ var (
 	cmdGet     = []byte("get")
 	cmdGets    = []byte("gets")
 	cmdDelete  = []byte("delete")
-
-	strValue = []byte("VALUE")
-	strEnd   = []byte("END\r\n")
+	cmdIncr    = []byte("incr")
+	cmdDecr    = []byte("decr")
+	cmdTouch   = []byte("touch")
+	cmdGat     = []byte("gat")
+	cmdGats    = []byte("gats")
+	cmdFlush   = []byte("flush_all")
+	cmdStats   = []byte("stats")
+	cmdSave    = []byte("save")
+	cmdGossip  = []byte("gossip")
+	cmdRing    = []byte("ring")
+	cmdMigrate = []byte("migrate")
+
+	cmdMetaGet        = []byte("mg")
+	cmdMetaSet        = []byte("ms")
+	cmdMetaDelete     = []byte("md")
+	cmdMetaArithmetic = []byte("ma")
+	cmdMetaNoop       = []byte("mn")
+
+	tokenNoreply = []byte("noreply")
+
+	strValue   = []byte("VALUE")
+	strStat    = []byte("STAT")
+	strMember  = []byte("MEMBER")
+	strMembers = []byte("MEMBERS")
+	strEnd     = []byte("END\r\n")
 
 	msgStored    = "STORED\r\n"
 	msgNotStored = "NOT_STORED\r\n"
 	msgDeleted   = "DELETED\r\n"
 	msgNotFound  = "NOT_FOUND\r\n"
 	msgExists    = "EXISTS\r\n"
+	msgTouched   = "TOUCHED\r\n"
+	msgOk        = "OK\r\n"
 	msgError     = "ERROR\r\n"
 
+	msgMetaHit       = "HD"
+	msgMetaValue     = "VA"
+	msgMetaNotStored = "NS"
+	msgMetaExists    = "EX"
+	msgMetaNotFound  = "NF"
+	msgMetaMiss      = "EN\r\n"
+	msgMetaNoop      = "MN\r\n"
+
+	errNonNumeric = "cannot increment or decrement non-numeric value"
+
 	maxKeyLength   = 1024
 	maxValueLength = 1024 * 1024
+	// maxLineLength is the longest command line servers read by default
+	maxLineLength = 4096
+	// maxArgumentsLength is the room a command line takes besides its key
+	maxArgumentsLength = 256
 )
 
+// validateKey returns why key is not valid, empty if it is: keys are limited
+// in length and may not hold whitespace or control characters, which the
+// text protocol has no room for.
+func validateKey(key []byte, maxLength int) string {
+	if len(key) > maxLength {
+		return "Key too long"
+	}
+
+	for _, c := range key {
+		if c <= ' ' || c == 0x7f {
+			return "Invalid character in key"
+		}
+	}
+
+	return ""
+}
+
+// metaFlag is a single flag of a meta command: a letter, optionally followed
+// by a token, e.g. «T30» or «v».
+type metaFlag struct {
+	name  byte
+	token []byte
+}
+
 type Parser struct {
 	cmd         []byte
 	failedToken string
 	position    int
 }
 
+// getNextToken returns the token after the current position, skipping the
+// run of spaces in front of it, or nil at the end of the line.
 func (this *Parser) getNextToken() []byte {
-	first := this.position
+	first := this.position + 1
+	for first < len(this.cmd) && this.cmd[first] == ' ' {
+		first++
+	}
 
-	if first += 1; first > len(this.cmd) {
+	if first >= len(this.cmd) {
 		return nil
 	}
 
@@ -50,22 +117,21 @@ func (this *Parser) getNextToken() []byte {
 		last += first
 	}
 
-	if first == last {
-		return nil
-	}
-
 	this.position = last
 
 	return this.cmd[first:last]
 }
 
 func (this *Parser) parseUint64() (flags uint64, ok bool) {
-	uintStr := this.getNextToken()
+	return parseUint64(this.getNextToken())
+}
+
+func parseUint64(uintStr []byte) (value uint64, ok bool) {
 	if uintStr == nil {
 		return
 	}
 
-	flags, err := strconv.ParseUint(string(uintStr[:]), 10, 64)
+	value, err := strconv.ParseUint(string(uintStr[:]), 10, 64)
 	if err != nil {
 		return
 	}
@@ -92,105 +158,321 @@ func (this *Parser) parseData(size uint64) []byte {
 	return this.cmd[first:last]
 }
 
-func (this *Parser) parseStoreCmd(cmd []byte) (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, casid uint64, ok bool) {
+// countTokens returns the number of tokens after the current position,
+// which it leaves as it is.
+func (this *Parser) countTokens() (count int) {
+	position := this.position
+	for this.getNextToken() != nil {
+		count++
+	}
+
+	this.position = position
+	return
+}
+
+// parseNoreply accepts an optional trailing «noreply» token.
+func (this *Parser) parseNoreply() (noreply bool, ok bool) {
+	token := this.getNextToken()
+	if token == nil {
+		return false, true
+	}
+
+	if !bytes.Equal(token, tokenNoreply) {
+		this.failedToken = "noreply"
+		return
+	}
+
+	return true, true
+}
+
+// The parse functions of commands read their arguments into a textRequest,
+// starting where the parser stands, right after the name of the command.
+// The exported Parse*Cmd methods wrap them for a whole line.
+
+// parseCmd parses the line as a cmd command with parse.
+func (this *Parser) parseCmd(cmd []byte, parse func(parser *Parser, request *textRequest) bool) (request textRequest, ok bool) {
 	this.position = len(cmd)
+	ok = parse(this, &request)
+	return
+}
 
-	key = this.getNextToken()
-	if key == nil {
+func (this *Parser) parseStoreCmd(request *textRequest) (ok bool) {
+	if !this.parseStorageArgs(request) {
+		return
+	}
+
+	request.noreply, ok = this.parseNoreply()
+	return
+}
+
+func (this *Parser) ParseSetCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdSet, (*Parser).parseStoreCmd)
+	return request.key, request.priority, request.flags, request.exptime, request.size, request.noreply, ok
+}
+
+func (this *Parser) ParseAddCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdAdd, (*Parser).parseStoreCmd)
+	return request.key, request.priority, request.flags, request.exptime, request.size, request.noreply, ok
+}
+
+func (this *Parser) ParseReplaceCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdReplace, (*Parser).parseStoreCmd)
+	return request.key, request.priority, request.flags, request.exptime, request.size, request.noreply, ok
+}
+
+func (this *Parser) ParseAppendCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdAppend, (*Parser).parseStoreCmd)
+	return request.key, request.priority, request.flags, request.exptime, request.size, request.noreply, ok
+}
+
+func (this *Parser) ParsePrependCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdPrepend, (*Parser).parseStoreCmd)
+	return request.key, request.priority, request.flags, request.exptime, request.size, request.noreply, ok
+}
+
+func (this *Parser) parseCasCmd(request *textRequest) (ok bool) {
+	if !this.parseStorageArgs(request) {
+		return
+	}
+
+	if request.casid, ok = this.parseUint64(); !ok {
+		this.failedToken = "casid"
+		return
+	}
+
+	request.noreply, ok = this.parseNoreply()
+	return
+}
+
+func (this *Parser) ParseCasCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, casid uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdCas, (*Parser).parseCasCmd)
+	return request.key, request.priority, request.flags, request.exptime, request.size, request.casid, request.noreply, ok
+}
+
+// parseStorageArgs parses the arguments storage commands share.
+func (this *Parser) parseStorageArgs(request *textRequest) (ok bool) {
+	request.key = this.getNextToken()
+	if request.key == nil {
 		this.failedToken = "key"
 		return
 	}
 
-	priority, ok = this.parseUint64()
-	if !ok {
+	if request.priority, ok = this.parseUint64(); !ok {
 		this.failedToken = "priority"
 		return
 	}
 
-	flags, ok = this.parseUint64()
-	if !ok {
+	if request.flags, ok = this.parseUint64(); !ok {
 		this.failedToken = "flags"
 		return
 	}
 
-	exptime, ok = this.parseUint64()
-	if !ok {
+	if request.exptime, ok = this.parseUint64(); !ok {
 		this.failedToken = "exptime"
 		return
 	}
 
-	size, ok = this.parseUint64()
-	if !ok {
+	if request.size, ok = this.parseUint64(); !ok {
 		this.failedToken = "size"
-		return
 	}
 
-	if bytes.Equal(cmd, cmdCas) {
-		casid, ok = this.parseUint64()
-		if !ok {
-			this.failedToken = "casid"
-			return
-		}
+	return
+}
+
+func (this *Parser) parseRetrievalCmd(request *textRequest) (ok bool) {
+	request.keys, ok = this.parseKeys()
+	return
+}
+
+func (this *Parser) ParseGetCmd() (keys [][]byte, ok bool) {
+	request, ok := this.parseCmd(cmdGet, (*Parser).parseRetrievalCmd)
+	return request.keys, ok
+}
+
+func (this *Parser) ParseGetsCmd() (keys [][]byte, ok bool) {
+	request, ok := this.parseCmd(cmdGets, (*Parser).parseRetrievalCmd)
+	return request.keys, ok
+}
+
+func (this *Parser) parseKeys() (keys [][]byte, ok bool) {
+	for key := this.getNextToken(); key != nil; key = this.getNextToken() {
+		keys = append(keys, key)
 	}
 
-	// value = this.parseData(size)
-	// if value == nil {
-	// 	this.failedToken = "value"
-	// 	return
-	// }
+	if len(keys) == 0 {
+		this.failedToken = "key"
+		return
+	}
 
 	ok = true
 	return
 }
 
-func (this *Parser) ParseSetCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, ok bool) {
-	key, priority, flags, exptime, size, _, ok = this.parseStoreCmd(cmdSet)
+func (this *Parser) parseTouchingRetrievalCmd(request *textRequest) (ok bool) {
+	if request.exptime, ok = this.parseUint64(); !ok {
+		this.failedToken = "exptime"
+		return
+	}
+
+	request.keys, ok = this.parseKeys()
 	return
 }
 
-func (this *Parser) ParseAddCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, ok bool) {
-	key, priority, flags, exptime, size, _, ok = this.parseStoreCmd(cmdAdd)
+func (this *Parser) ParseGatCmd() (exptime uint64, keys [][]byte, ok bool) {
+	request, ok := this.parseCmd(cmdGat, (*Parser).parseTouchingRetrievalCmd)
+	return request.exptime, request.keys, ok
+}
+
+func (this *Parser) ParseGatsCmd() (exptime uint64, keys [][]byte, ok bool) {
+	request, ok := this.parseCmd(cmdGats, (*Parser).parseTouchingRetrievalCmd)
+	return request.exptime, request.keys, ok
+}
+
+func (this *Parser) parseTouchCmd(request *textRequest) (ok bool) {
+	request.key = this.getNextToken()
+	if request.key == nil {
+		this.failedToken = "key"
+		return
+	}
+
+	if request.exptime, ok = this.parseUint64(); !ok {
+		this.failedToken = "exptime"
+	}
+
 	return
 }
 
-func (this *Parser) ParseReplaceCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, ok bool) {
-	key, priority, flags, exptime, size, _, ok = this.parseStoreCmd(cmdReplace)
+func (this *Parser) ParseTouchCmd() (key []byte, exptime uint64, ok bool) {
+	request, ok := this.parseCmd(cmdTouch, (*Parser).parseTouchCmd)
+	return request.key, request.exptime, ok
+}
+
+func (this *Parser) parseDeleteCmd(request *textRequest) (ok bool) {
+	request.key = this.getNextToken()
+	if request.key == nil {
+		this.failedToken = "key"
+		return
+	}
+
+	request.noreply, ok = this.parseNoreply()
 	return
 }
 
-func (this *Parser) ParseAppendCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, ok bool) {
-	key, priority, flags, exptime, size, _, ok = this.parseStoreCmd(cmdAppend)
+func (this *Parser) ParseDeleteCmd() (key []byte, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdDelete, (*Parser).parseDeleteCmd)
+	return request.key, request.noreply, ok
+}
+
+func (this *Parser) parseArithmeticCmd(request *textRequest) (ok bool) {
+	request.key = this.getNextToken()
+	if request.key == nil {
+		this.failedToken = "key"
+		return
+	}
+
+	if request.delta, ok = this.parseUint64(); !ok {
+		this.failedToken = "delta"
+	}
+
 	return
 }
 
-func (this *Parser) ParsePrependCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, ok bool) {
-	key, priority, flags, exptime, size, _, ok = this.parseStoreCmd(cmdPrepend)
+func (this *Parser) ParseIncrCmd() (key []byte, delta uint64, ok bool) {
+	request, ok := this.parseCmd(cmdIncr, (*Parser).parseArithmeticCmd)
+	return request.key, request.delta, ok
+}
+
+func (this *Parser) ParseDecrCmd() (key []byte, delta uint64, ok bool) {
+	request, ok := this.parseCmd(cmdDecr, (*Parser).parseArithmeticCmd)
+	return request.key, request.delta, ok
+}
+
+func (this *Parser) parseFlushAllCmd(request *textRequest) (ok bool) {
+	token := this.getNextToken()
+	if token != nil && !bytes.Equal(token, tokenNoreply) {
+		if request.delay, ok = parseUint64(token); !ok {
+			this.failedToken = "delay"
+			return
+		}
+
+		token = this.getNextToken()
+	}
+
+	if token != nil {
+		if !bytes.Equal(token, tokenNoreply) {
+			this.failedToken = "noreply"
+			return false
+		}
+
+		request.noreply = true
+	}
+
+	return true
+}
+
+func (this *Parser) ParseFlushAllCmd() (delay uint64, noreply bool, ok bool) {
+	request, ok := this.parseCmd(cmdFlush, (*Parser).parseFlushAllCmd)
+	return request.delay, request.noreply, ok
+}
+
+func (this *Parser) parseStatsCmd(request *textRequest) (ok bool) {
+	request.group = this.getNextToken()
+	return true
+}
+
+func (this *Parser) ParseStatsCmd() (group []byte, ok bool) {
+	request, ok := this.parseCmd(cmdStats, (*Parser).parseStatsCmd)
+	return request.group, ok
+}
+
+// parseGossipCmd parses the members a peer knows of, as «addr heartbeat
+// state» triples.
+func (this *Parser) parseGossipCmd(request *textRequest) (ok bool) {
+	request.members, ok = this.parseMembers()
 	return
 }
 
-func (this *Parser) ParseCasCmd() (key []byte, priority uint64, flags uint64, exptime uint64, size uint64, casid uint64, ok bool) {
-	return this.parseStoreCmd(cmdCas)
+func (this *Parser) ParseGossipCmd() (members []memberDigest, ok bool) {
+	request, ok := this.parseCmd(cmdGossip, (*Parser).parseGossipCmd)
+	return request.members, ok
 }
 
-func (this *Parser) ParseGetCmd() (key []byte, ok bool) {
-	this.position = len(cmdGet)
+func (this *Parser) ParseGossipResponse() (members []memberDigest, ok bool) {
+	this.position = len(strMembers)
+	return this.parseMembers()
+}
 
-	key = this.getNextToken()
-	if key == nil {
-		this.failedToken = "key"
-		return
+func (this *Parser) parseMembers() (members []memberDigest, ok bool) {
+	for addr := this.getNextToken(); addr != nil; addr = this.getNextToken() {
+		heartbeat, ok := this.parseUint64()
+		if !ok {
+			this.failedToken = "heartbeat"
+			return nil, false
+		}
+
+		var left bool
+		switch state := string(this.getNextToken()); state {
+		case memberAlive:
+		case memberLeft:
+			left = true
+		default:
+			this.failedToken = "state"
+			return nil, false
+		}
+
+		members = append(members, memberDigest{addr: string(addr), heartbeat: heartbeat, left: left})
 	}
 
 	ok = true
 	return
 }
 
-func (this *Parser) ParseGetsCmd() (key []byte, ok bool) {
-	this.position = len(cmdGets)
+func (this *Parser) ParseRingResponse() (addr []byte, ok bool) {
+	this.position = len(strMember)
 
-	key = this.getNextToken()
-	if key == nil {
-		this.failedToken = "key"
+	addr = this.getNextToken()
+	if addr == nil {
+		this.failedToken = "addr"
 		return
 	}
 
@@ -198,12 +480,31 @@ func (this *Parser) ParseGetsCmd() (key []byte, ok bool) {
 	return
 }
 
-func (this *Parser) ParseDeleteCmd() (key []byte, ok bool) {
-	this.position = len(cmdDelete)
+func (this *Parser) parseMigrateCmd(request *textRequest) (ok bool) {
+	if request.size, ok = this.parseUint64(); !ok {
+		this.failedToken = "size"
+	}
+
+	return
+}
 
-	key = this.getNextToken()
-	if key == nil {
-		this.failedToken = "key"
+func (this *Parser) ParseMigrateCmd() (size uint64, ok bool) {
+	request, ok := this.parseCmd(cmdMigrate, (*Parser).parseMigrateCmd)
+	return request.size, ok
+}
+
+func (this *Parser) ParseStatResponse() (name []byte, value []byte, ok bool) {
+	this.position = len(strStat)
+
+	name = this.getNextToken()
+	if name == nil {
+		this.failedToken = "name"
+		return
+	}
+
+	value = this.getNextToken()
+	if value == nil {
+		this.failedToken = "value"
 		return
 	}
 
@@ -211,10 +512,65 @@ func (this *Parser) ParseDeleteCmd() (key []byte, ok bool) {
 	return
 }
 
-func (this *Parser) ParseGetResponse(cmd []byte) (flags uint64, size uint64, casid uint64, ok bool) {
+func (this *Parser) parseMetaFlags() (flags []metaFlag) {
+	for token := this.getNextToken(); token != nil; token = this.getNextToken() {
+		flags = append(flags, metaFlag{name: token[0], token: token[1:]})
+	}
+
+	return
+}
+
+func (this *Parser) parseMetaCmd(request *textRequest) (ok bool) {
+	request.key = this.getNextToken()
+	if request.key == nil {
+		this.failedToken = "key"
+		return
+	}
+
+	request.meta = this.parseMetaFlags()
+	return true
+}
+
+func (this *Parser) ParseMetaGetCmd() (key []byte, flags []metaFlag, ok bool) {
+	request, ok := this.parseCmd(cmdMetaGet, (*Parser).parseMetaCmd)
+	return request.key, request.meta, ok
+}
+
+func (this *Parser) ParseMetaDeleteCmd() (key []byte, flags []metaFlag, ok bool) {
+	request, ok := this.parseCmd(cmdMetaDelete, (*Parser).parseMetaCmd)
+	return request.key, request.meta, ok
+}
+
+func (this *Parser) ParseMetaArithmeticCmd() (key []byte, flags []metaFlag, ok bool) {
+	request, ok := this.parseCmd(cmdMetaArithmetic, (*Parser).parseMetaCmd)
+	return request.key, request.meta, ok
+}
+
+func (this *Parser) parseMetaSetCmd(request *textRequest) (ok bool) {
+	request.key = this.getNextToken()
+	if request.key == nil {
+		this.failedToken = "key"
+		return
+	}
+
+	if request.size, ok = this.parseUint64(); !ok {
+		this.failedToken = "size"
+		return
+	}
+
+	request.meta = this.parseMetaFlags()
+	return true
+}
+
+func (this *Parser) ParseMetaSetCmd() (key []byte, size uint64, flags []metaFlag, ok bool) {
+	request, ok := this.parseCmd(cmdMetaSet, (*Parser).parseMetaSetCmd)
+	return request.key, request.size, request.meta, ok
+}
+
+func (this *Parser) ParseGetResponse(cmd []byte) (key []byte, flags uint64, size uint64, casid uint64, ok bool) {
 	this.position = len(strValue)
 
-	key := this.getNextToken()
+	key = this.getNextToken()
 	if key == nil {
 		this.failedToken = "key"
 		return
@@ -232,7 +588,7 @@ func (this *Parser) ParseGetResponse(cmd []byte) (flags uint64, size uint64, cas
 		return
 	}
 
-	if bytes.Equal(cmd, cmdGets) {
+	if bytes.Equal(cmd, cmdGets) || bytes.Equal(cmd, cmdGats) {
 		casid, ok = this.parseUint64()
 		if !ok {
 			this.failedToken = "casid"
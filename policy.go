@@ -0,0 +1,449 @@
+package whatever
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"unsafe"
+)
+
+// EvictionPolicy decides which entry leaves the cache when it is over its
+// size limit. Every shard of the cache has its own policy and calls it with
+// the shard mutex held, so implementations need no locking of their own.
+type EvictionPolicy interface {
+	// OnInsert starts tracking a new entry.
+	OnInsert(entry *Entry)
+	// OnAccess is called whenever an entry is read.
+	OnAccess(entry *Entry)
+	// OnUpdate is called after the value or the priority of an entry changed.
+	OnUpdate(entry *Entry)
+	// OnRemove stops tracking an entry, whatever the reason it left.
+	OnRemove(entry *Entry)
+	// Victim returns the entry to evict next, or nil if there is none. It
+	// must not change the state of the policy, as the cache asks every shard
+	// for its victim but evicts only one of them.
+	Victim() *Entry
+}
+
+// RankedPolicy is an eviction policy whose victims can be compared across
+// shards: the victim with the lowest rank is evicted first. Victims of
+// policies without a rank are compared by their last use only.
+type RankedPolicy interface {
+	EvictionPolicy
+	Rank(entry *Entry) float64
+}
+
+// EvictingPolicy is an eviction policy which tells evictions from entries
+// leaving for any other reason: OnEvict is called for every victim, right
+// before OnRemove.
+type EvictingPolicy interface {
+	EvictionPolicy
+	OnEvict(entry *Entry)
+}
+
+// SizedPolicy is an eviction policy which tells the memory it takes to track
+// an entry, so that it is charged to the entry. Entries of policies which do
+// not tell are charged for a list element.
+type SizedPolicy interface {
+	EvictionPolicy
+	HandleSize() int
+}
+
+// handleSize returns the memory policy takes to track an entry.
+func handleSize(policy EvictionPolicy) int {
+	if sized, ok := policy.(SizedPolicy); ok {
+		return sized.HandleSize()
+	}
+
+	return int(unsafe.Sizeof(list.Element{}))
+}
+
+// EvictionPolicyFactory returns the constructor of a policy by its name:
+// «priority», «lru», «lfu», «fifo» or «gds».
+func EvictionPolicyFactory(name string) (func() EvictionPolicy, error) {
+	switch name {
+	case "priority":
+		return func() EvictionPolicy { return NewPriorityPolicy() }, nil
+	case "lru":
+		return func() EvictionPolicy { return NewLRUPolicy() }, nil
+	case "lfu":
+		return func() EvictionPolicy { return NewLFUPolicy() }, nil
+	case "fifo":
+		return func() EvictionPolicy { return NewFIFOPolicy() }, nil
+	case "gds":
+		return func() EvictionPolicy { return NewGreedyDualSizePolicy() }, nil
+	}
+
+	return nil, fmt.Errorf("Unknown eviction policy %s", name)
+}
+
+// listPolicy keeps entries in a list, evicting from its front.
+type listPolicy struct {
+	l *list.List
+}
+
+func (this *listPolicy) OnInsert(entry *Entry) {
+	entry.handle = this.l.PushBack(entry)
+}
+
+func (this *listPolicy) OnAccess(entry *Entry) {
+}
+
+func (this *listPolicy) OnUpdate(entry *Entry) {
+}
+
+func (this *listPolicy) OnRemove(entry *Entry) {
+	this.l.Remove(entry.handle.(*list.Element))
+	entry.handle = nil
+}
+
+func (this *listPolicy) Victim() *Entry {
+	if element := this.l.Front(); element != nil {
+		return element.Value.(*Entry)
+	}
+
+	return nil
+}
+
+func (this *listPolicy) HandleSize() int {
+	return int(unsafe.Sizeof(list.Element{}))
+}
+
+// PriorityPolicy evicts entries with the lowest priority first, the least
+// recently used one within a priority. Every priority has its own LRU list
+// and a heap of the non-empty priorities finds the lowest one, so inserts
+// cost O(log p) for p distinct priorities instead of a scan of all entries.
+type PriorityPolicy struct {
+	tiers map[uint64]*priorityTier
+	heap  tierHeap
+}
+
+type priorityTier struct {
+	priority uint64
+	l        *list.List
+	index    int
+}
+
+// priorityNode is the handle of an entry: its tier is kept because the
+// priority of the entry may already have changed when OnUpdate is called.
+type priorityNode struct {
+	tier    *priorityTier
+	element *list.Element
+}
+
+type tierHeap []*priorityTier
+
+func (this tierHeap) Len() int {
+	return len(this)
+}
+
+func (this tierHeap) Less(i, j int) bool {
+	return this[i].priority < this[j].priority
+}
+
+func (this tierHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *tierHeap) Push(x interface{}) {
+	tier := x.(*priorityTier)
+	tier.index = len(*this)
+	*this = append(*this, tier)
+}
+
+func (this *tierHeap) Pop() interface{} {
+	old := *this
+	tier := old[len(old)-1]
+	old[len(old)-1] = nil
+	*this = old[:len(old)-1]
+
+	return tier
+}
+
+func NewPriorityPolicy() *PriorityPolicy {
+	policy := new(PriorityPolicy)
+	policy.tiers = make(map[uint64]*priorityTier)
+
+	return policy
+}
+
+func (this *PriorityPolicy) OnInsert(entry *Entry) {
+	tier, ok := this.tiers[entry.priority]
+	if !ok {
+		tier = &priorityTier{priority: entry.priority, l: list.New()}
+		this.tiers[entry.priority] = tier
+		heap.Push(&this.heap, tier)
+	}
+
+	entry.handle = &priorityNode{tier: tier, element: tier.l.PushBack(entry)}
+}
+
+func (this *PriorityPolicy) OnAccess(entry *Entry) {
+	node := entry.handle.(*priorityNode)
+	node.tier.l.MoveToBack(node.element)
+}
+
+func (this *PriorityPolicy) OnUpdate(entry *Entry) {
+	if node := entry.handle.(*priorityNode); node.tier.priority == entry.priority {
+		node.tier.l.MoveToBack(node.element)
+		return
+	}
+
+	this.OnRemove(entry)
+	this.OnInsert(entry)
+}
+
+func (this *PriorityPolicy) OnRemove(entry *Entry) {
+	node := entry.handle.(*priorityNode)
+	node.tier.l.Remove(node.element)
+	if node.tier.l.Len() == 0 {
+		heap.Remove(&this.heap, node.tier.index)
+		delete(this.tiers, node.tier.priority)
+	}
+
+	entry.handle = nil
+}
+
+func (this *PriorityPolicy) Victim() *Entry {
+	if len(this.heap) == 0 {
+		return nil
+	}
+
+	return this.heap[0].l.Front().Value.(*Entry)
+}
+
+func (this *PriorityPolicy) Rank(entry *Entry) float64 {
+	return float64(entry.priority)
+}
+
+func (this *PriorityPolicy) HandleSize() int {
+	return int(unsafe.Sizeof(priorityNode{}) + unsafe.Sizeof(list.Element{}))
+}
+
+// LRUPolicy evicts the least recently used entry.
+type LRUPolicy struct {
+	listPolicy
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{listPolicy{list.New()}}
+}
+
+func (this *LRUPolicy) OnAccess(entry *Entry) {
+	this.l.MoveToBack(entry.handle.(*list.Element))
+}
+
+func (this *LRUPolicy) OnUpdate(entry *Entry) {
+	this.l.MoveToBack(entry.handle.(*list.Element))
+}
+
+// FIFOPolicy evicts the oldest entry, regardless of how it is used.
+type FIFOPolicy struct {
+	listPolicy
+}
+
+func NewFIFOPolicy() *FIFOPolicy {
+	return &FIFOPolicy{listPolicy{list.New()}}
+}
+
+func (this *FIFOPolicy) Rank(entry *Entry) float64 {
+	return float64(entry.inserted)
+}
+
+// LFUPolicy evicts the least frequently used entry, the oldest one among
+// equally used entries.
+type LFUPolicy struct {
+	items   lfuHeap
+	counter uint64
+}
+
+type lfuItem struct {
+	entry *Entry
+	count uint64
+	seq   uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (this lfuHeap) Len() int {
+	return len(this)
+}
+
+func (this lfuHeap) Less(i, j int) bool {
+	if this[i].count != this[j].count {
+		return this[i].count < this[j].count
+	}
+
+	return this[i].seq < this[j].seq
+}
+
+func (this lfuHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*this)
+	*this = append(*this, item)
+}
+
+func (this *lfuHeap) Pop() interface{} {
+	old := *this
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*this = old[:len(old)-1]
+
+	return item
+}
+
+func NewLFUPolicy() *LFUPolicy {
+	return new(LFUPolicy)
+}
+
+func (this *LFUPolicy) OnInsert(entry *Entry) {
+	item := &lfuItem{entry: entry, seq: this.counter}
+	this.counter++
+	entry.handle = item
+	heap.Push(&this.items, item)
+}
+
+func (this *LFUPolicy) OnAccess(entry *Entry) {
+	item := entry.handle.(*lfuItem)
+	item.count++
+	heap.Fix(&this.items, item.index)
+}
+
+func (this *LFUPolicy) OnUpdate(entry *Entry) {
+	this.OnAccess(entry)
+}
+
+func (this *LFUPolicy) OnRemove(entry *Entry) {
+	heap.Remove(&this.items, entry.handle.(*lfuItem).index)
+	entry.handle = nil
+}
+
+func (this *LFUPolicy) Victim() *Entry {
+	if len(this.items) == 0 {
+		return nil
+	}
+
+	return this.items[0].entry
+}
+
+func (this *LFUPolicy) Rank(entry *Entry) float64 {
+	return float64(entry.handle.(*lfuItem).count)
+}
+
+// HandleSize counts the item and its slot in the heap.
+func (this *LFUPolicy) HandleSize() int {
+	return int(unsafe.Sizeof(lfuItem{}) + unsafe.Sizeof(&lfuItem{}))
+}
+
+// GreedyDualSizePolicy is cost-aware: the priority of an entry is read as the
+// cost of recomputing it, and entries with the lowest cost per byte leave
+// first. Every entry is credited with L + cost/size on insert and access,
+// where L is inflated to the credit of each evicted entry, so that entries
+// which are not used anymore age out regardless of their cost. L is kept
+// per shard, so victims are ranked by their credit above it, which shards
+// that evict at different rates can compare.
+type GreedyDualSizePolicy struct {
+	items     gdsHeap
+	inflation float64
+}
+
+type gdsItem struct {
+	entry  *Entry
+	credit float64
+	index  int
+}
+
+type gdsHeap []*gdsItem
+
+func (this gdsHeap) Len() int {
+	return len(this)
+}
+
+func (this gdsHeap) Less(i, j int) bool {
+	return this[i].credit < this[j].credit
+}
+
+func (this gdsHeap) Swap(i, j int) {
+	this[i], this[j] = this[j], this[i]
+	this[i].index = i
+	this[j].index = j
+}
+
+func (this *gdsHeap) Push(x interface{}) {
+	item := x.(*gdsItem)
+	item.index = len(*this)
+	*this = append(*this, item)
+}
+
+func (this *gdsHeap) Pop() interface{} {
+	old := *this
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*this = old[:len(old)-1]
+
+	return item
+}
+
+func NewGreedyDualSizePolicy() *GreedyDualSizePolicy {
+	return new(GreedyDualSizePolicy)
+}
+
+func (this *GreedyDualSizePolicy) credit(entry *Entry) float64 {
+	size := entry.Size()
+	if size == 0 {
+		size = 1
+	}
+
+	return this.inflation + float64(entry.priority)/float64(size)
+}
+
+func (this *GreedyDualSizePolicy) OnInsert(entry *Entry) {
+	item := &gdsItem{entry: entry, credit: this.credit(entry)}
+	entry.handle = item
+	heap.Push(&this.items, item)
+}
+
+func (this *GreedyDualSizePolicy) OnAccess(entry *Entry) {
+	item := entry.handle.(*gdsItem)
+	item.credit = this.credit(entry)
+	heap.Fix(&this.items, item.index)
+}
+
+func (this *GreedyDualSizePolicy) OnUpdate(entry *Entry) {
+	this.OnAccess(entry)
+}
+
+func (this *GreedyDualSizePolicy) OnEvict(entry *Entry) {
+	this.inflation = entry.handle.(*gdsItem).credit
+}
+
+func (this *GreedyDualSizePolicy) OnRemove(entry *Entry) {
+	heap.Remove(&this.items, entry.handle.(*gdsItem).index)
+	entry.handle = nil
+}
+
+func (this *GreedyDualSizePolicy) Victim() *Entry {
+	if len(this.items) == 0 {
+		return nil
+	}
+
+	return this.items[0].entry
+}
+
+func (this *GreedyDualSizePolicy) Rank(entry *Entry) float64 {
+	return entry.handle.(*gdsItem).credit - this.inflation
+}
+
+// HandleSize counts the item and its slot in the heap.
+func (this *GreedyDualSizePolicy) HandleSize() int {
+	return int(unsafe.Sizeof(gdsItem{}) + unsafe.Sizeof(&gdsItem{}))
+}
@@ -0,0 +1,322 @@
+package whatever
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A replica connects to its primary and sends «replicate». The primary
+// answers with «SNAPSHOT <length>», the snapshot of its cache, and then
+// streams every change as a record of the append-only log format, with a
+// heartbeat record carrying its clock every replicationHeartbeat so that
+// the replica knows how far behind it is.
+const (
+	replicationHeartbeat = time.Second
+	replicationRetry     = time.Second
+	// a replica which falls this far behind is dropped, and resyncs
+	replicationMaxPending = 64 * 1024 * 1024
+
+	msgReadOnly = "SERVER_ERROR Read-only replica\r\n"
+)
+
+var cmdReplicate = []byte("replicate")
+
+func init() {
+	registerCommand(&command{name: string(cmdReplicate), minArgs: 0, maxArgs: 0, execute: (*session).runReplicateCmd, final: true})
+}
+
+// replicaFeed is the journal of a replica on its primary. Changes are kept
+// in a buffer which the session sends, so that a slow replica never holds
+// a shard mutex.
+type replicaFeed struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	buffer bytes.Buffer
+	closed bool
+}
+
+// replicationState is what a replica reports in «stats».
+type replicationState struct {
+	connected int32
+	offset    int64
+	heartbeat int64
+}
+
+func newReplicaFeed() *replicaFeed {
+	feed := new(replicaFeed)
+	feed.cond = sync.NewCond(&feed.mutex)
+
+	return feed
+}
+
+func (this *replicaFeed) record(op byte, entry *Entry) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	writeRecord(&this.buffer, op, entry)
+	if this.buffer.Len() > replicationMaxPending {
+		log.Printf("Dropping replica which is %d bytes behind", this.buffer.Len())
+		this.closed = true
+	}
+	this.cond.Signal()
+}
+
+func (this *replicaFeed) heartbeat() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	payload := make([]byte, binary.MaxVarintLen64)
+	writeRecordPayload(&this.buffer, journalHeartbeat, payload[:binary.PutVarint(payload, time.Now().UnixNano())])
+	this.cond.Signal()
+}
+
+func (this *replicaFeed) close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.closed = true
+	this.cond.Signal()
+}
+
+// next waits for changes and returns them, nil once the feed is closed.
+func (this *replicaFeed) next() []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for this.buffer.Len() == 0 && !this.closed {
+		this.cond.Wait()
+	}
+
+	if this.closed {
+		return nil
+	}
+
+	data := append([]byte(nil), this.buffer.Bytes()...)
+	this.buffer.Reset()
+	return data
+}
+
+// runReplicateCmd turns the session into the feed of a replica, until the
+// connection breaks.
+func (this *session) runReplicateCmd(request *textRequest) {
+	feed := newReplicaFeed()
+	cache := this.server.cache
+
+	// a replica is silent and may wait long for changes, it never idles out
+	this.conn.SetDeadline(time.Time{})
+
+	// the feed starts before the snapshot, so that no change is missed:
+	// those which are in both are replayed twice, which is harmless
+	cache.addJournal(feed)
+	defer cache.removeJournal(feed)
+	defer feed.close()
+
+	atomic.AddInt64(&this.server.stats.replicas, 1)
+	defer atomic.AddInt64(&this.server.stats.replicas, -1)
+
+	var snapshot bytes.Buffer
+	if err := cache.Save(&snapshot); err != nil {
+		log.Printf("Cannot take snapshot for replica %s: %s", this.conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Printf("Sending %d bytes of snapshot to replica %s", snapshot.Len(), this.conn.RemoteAddr())
+	fmt.Fprintf(this.rw, "SNAPSHOT %d\r\n", snapshot.Len())
+	this.rw.Write(snapshot.Bytes())
+	if err := this.rw.Flush(); err != nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(replicationHeartbeat)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			feed.mutex.Lock()
+			closed := feed.closed
+			feed.mutex.Unlock()
+
+			if closed {
+				return
+			}
+			feed.heartbeat()
+		}
+	}()
+
+	// replicas never send anything else, so a read only returns once the
+	// connection is gone
+	go func() {
+		io.Copy(ioutil.Discard, this.rw)
+		feed.close()
+	}()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-this.server.done:
+			feed.close()
+		case <-finished:
+		}
+	}()
+
+	for {
+		data := feed.next()
+		if data == nil {
+			return
+		}
+
+		if _, err := this.rw.Write(data); err != nil {
+			return
+		}
+
+		if err := this.rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// ReplicateFrom makes the server a read-only replica of the server at addr,
+// which it keeps following in the background, resyncing from scratch
+// whenever the connection breaks.
+func (this *Server) ReplicateFrom(addr string) {
+	this.primary = addr
+	go this.replicate()
+}
+
+func (this *Server) replicate() {
+	for {
+		if err := this.follow(); err != nil {
+			log.Printf("Replication from %s failed: %s", this.primary, err)
+		}
+		atomic.StoreInt32(&this.replication.connected, 0)
+
+		select {
+		case <-this.done:
+			return
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+// follow loads the snapshot of the primary and applies its changes until
+// the connection breaks.
+func (this *Server) follow() (err error) {
+	conn, err := net.Dial("tcp", this.primary)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		// closing the connection is the only way to stop a blocked read
+		select {
+		case <-this.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	if _, err = fmt.Fprintf(conn, "%s\r\n", cmdReplicate); err != nil {
+		return
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	var length int64
+	if _, err = fmt.Sscanf(line, "SNAPSHOT %d", &length); err != nil {
+		return fmt.Errorf("Unexpected answer %q", line)
+	}
+
+	this.cache.Flush(0)
+	count, err := this.cache.Load(io.LimitReader(reader, length))
+	if err != nil {
+		return
+	}
+
+	log.Printf("Loaded %d entries from primary %s", count, this.primary)
+	atomic.StoreInt64(&this.replication.offset, length)
+	atomic.StoreInt32(&this.replication.connected, 1)
+
+	for {
+		op, payload, recordLength, ok := readAppendLogRecord(reader)
+		if !ok {
+			return io.ErrUnexpectedEOF
+		}
+
+		if op == journalHeartbeat {
+			timestamp, err := binary.ReadVarint(bytes.NewReader(payload))
+			if err != nil {
+				return err
+			}
+			atomic.StoreInt64(&this.replication.heartbeat, timestamp)
+		} else if _, ok = applyRecord(this.cache, op, payload); !ok {
+			return fmt.Errorf("Malformed record of type %d", op)
+		}
+
+		atomic.AddInt64(&this.replication.offset, recordLength)
+	}
+}
+
+// replicationStats reports the role of the server and, on a replica, how
+// far it is behind its primary. The lag is measured against the clock of
+// the primary as of its last heartbeat, so it assumes synchronized clocks.
+func (this *Server) replicationStats() []stat {
+	if this.primary == "" {
+		return []stat{
+			{"role", "primary"},
+			{"connected_replicas", atomic.LoadInt64(&this.stats.replicas)},
+		}
+	}
+
+	stats := []stat{
+		{"role", "replica"},
+		{"primary", this.primary},
+		{"primary_link_status", "down"},
+		{"replication_offset", atomic.LoadInt64(&this.replication.offset)},
+	}
+
+	if atomic.LoadInt32(&this.replication.connected) == 1 {
+		stats[2].value = "up"
+	}
+
+	if heartbeat := atomic.LoadInt64(&this.replication.heartbeat); heartbeat != 0 {
+		stats = append(stats, stat{"replication_lag_ms", int64(time.Since(time.Unix(0, heartbeat)) / time.Millisecond)})
+	}
+
+	return stats
+}
+
+// readOnly answers writes on a replica with an error, reporting whether it
+// did. Like any other reply, the error is not sent for noreply commands.
+func (this *session) readOnly() bool {
+	if this.server.primary == "" {
+		return false
+	}
+
+	this.response.WriteString(msgReadOnly)
+	return true
+}
@@ -0,0 +1,64 @@
+package whatever
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// hashRing maps keys to server addresses by consistent hashing: every
+// server owns pointCount points, the checksums of its address followed by
+// the point number, and a key belongs to the server of the first point
+// above its own checksum. Clients and cluster members share it, so that
+// they agree on the owner of every key.
+type hashRing struct {
+	points []int
+	owners map[int]string
+}
+
+func newHashRing(addrs []string) *hashRing {
+	ring := &hashRing{owners: make(map[int]string)}
+	for _, addr := range addrs {
+		ring.add(addr)
+	}
+
+	return ring
+}
+
+func (this *hashRing) add(addr string) {
+	for i := 0; i < pointCount; i++ {
+		hash := int(crc32.ChecksumIEEE([]byte(addr + strconv.Itoa(i))))
+		this.points = append(this.points, hash)
+		this.owners[hash] = addr
+	}
+
+	sort.Ints(this.points)
+}
+
+// owner returns the address key belongs to, empty on an empty ring.
+func (this *hashRing) owner(key []byte) string {
+	if len(this.points) == 0 {
+		return ""
+	}
+
+	hash := int(crc32.ChecksumIEEE(key))
+	i := sort.Search(len(this.points), func(i int) bool { return this.points[i] > hash })
+	if i == len(this.points) {
+		i = 0
+	}
+
+	return this.owners[this.points[i]]
+}
+
+// members returns the distinct addresses in the order of their points.
+func (this *hashRing) members() (addrs []string) {
+	seen := make(map[string]bool)
+	for _, point := range this.points {
+		if addr := this.owners[point]; !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return
+}
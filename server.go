@@ -3,26 +3,111 @@ package whatever
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	version = "1.0.0"
+
+	acceptRetry          = 10 * time.Millisecond
+	shutdownPollInterval = 10 * time.Millisecond
+)
+
+// ErrServerClosed is returned by Start once the server is shut down.
+var ErrServerClosed = errors.New("Server closed")
+
+// Sessions are idle while they wait for a command, which Shutdown closes
+// them during, and active while they run one, which Shutdown lets finish.
+const (
+	sessionIdle int32 = iota
+	sessionActive
+	sessionClosed
 )
 
 type Server struct {
 	addr     string
 	cache    *Cache
-	parser   *Parser
-	response string
 	socket   *net.TCPListener
+	started  time.Time
+	stats    serverStats
+	snapshot string
+	log      *appendLog
+
+	// primary is the address of the server this one replicates, if any
+	primary     string
+	replication replicationState
+	done        chan struct{}
+
+	// cluster is the membership of the server, nil outside of a cluster
+	cluster *cluster
+
+	// idleTimeout closes connections which stay silent for that long
+	idleTimeout time.Duration
+
+	maxKeyLength   int
+	maxValueLength int
+
+	// mutex guards the socket and the sessions
+	mutex    sync.Mutex
+	sessions map[*session]struct{}
+	closing  int32
+}
+
+// serverStats holds the counters reported by «stats», updated atomically by
+// every session.
+type serverStats struct {
+	currConnections  int64
+	totalConnections uint64
+	cmdGet           uint64
+	cmdSet           uint64
+	cmdTouch         uint64
+	cmdFlush         uint64
+	getHits          uint64
+	getMisses        uint64
+	replicas         int64
+	connectionErrors uint64
+	idleKicks        uint64
+}
+
+// session holds the state of a single client connection, so that concurrent
+// connections never share a parser or a response buffer.
+type session struct {
+	server   *Server
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	parser   *Parser
+	response bytes.Buffer
+	noreply  bool
+	commands uint64
+	state    int32
+	// err is the network or protocol error which ends the session
+	err error
+	// line holds the current command out of the read buffer, which reading
+	// a data block refills
+	line []byte
 }
 
 func NewServer(addr string, verbose bool, maxLength int) *Server {
 	server := new(Server)
 	server.addr = addr
 	server.cache = NewCache(maxLength)
-	server.parser = new(Parser)
+	server.started = time.Now()
+	server.done = make(chan struct{})
+	server.sessions = make(map[*session]struct{})
+	server.maxKeyLength = maxKeyLength
+	server.maxValueLength = maxValueLength
 
 	if !verbose {
 		log.SetOutput(ioutil.Discard)
@@ -31,283 +116,932 @@ func NewServer(addr string, verbose bool, maxLength int) *Server {
 	return server
 }
 
-func (this *Server) Start() {
+// SetEvictionPolicy changes how the cache picks the entries to evict.
+func (this *Server) SetEvictionPolicy(newPolicy func() EvictionPolicy) {
+	this.cache.SetEvictionPolicy(newPolicy)
+}
+
+// EnableSlabs makes the cache store values in reusable slab chunks.
+func (this *Server) EnableSlabs() {
+	this.cache.EnableSlabs()
+}
+
+// SetAdmissionPolicy installs a filter for new keys, nil admitting all.
+func (this *Server) SetAdmissionPolicy(newAdmission func() AdmissionPolicy) {
+	this.cache.SetAdmissionPolicy(newAdmission)
+}
+
+// SetIdleTimeout makes the server close connections which send nothing for
+// timeout, zero meaning never. The data block of a command has to arrive
+// within timeout as well.
+func (this *Server) SetIdleTimeout(timeout time.Duration) {
+	this.idleTimeout = timeout
+}
+
+// SetMaxKeyLength changes the length keys are limited to, 1024 by default.
+// Sessions read lines long enough for commands with such keys.
+func (this *Server) SetMaxKeyLength(length int) {
+	this.maxKeyLength = length
+}
+
+// SetMaxValueLength changes the length values are limited to, 1MB by
+// default.
+func (this *Server) SetMaxValueLength(length int) {
+	this.maxValueLength = length
+}
+
+// SetSnapshotFile sets the file «save» writes the snapshot of the cache to.
+func (this *Server) SetSnapshotFile(path string) {
+	this.snapshot = path
+}
+
+// LoadSnapshot fills the cache from the snapshot file, if there is one.
+func (this *Server) LoadSnapshot() (err error) {
+	count, err := this.cache.LoadFile(this.snapshot)
+	if os.IsNotExist(err) {
+		log.Printf("No snapshot found at %s", this.snapshot)
+		return nil
+	} else if err != nil {
+		return
+	}
+
+	log.Printf("Loaded %d entries from snapshot %s", count, this.snapshot)
+	return
+}
+
+// SaveSnapshot writes the snapshot file.
+func (this *Server) SaveSnapshot() (err error) {
+	if this.snapshot == "" {
+		return errors.New("No snapshot file configured")
+	}
+
+	if err = this.cache.SaveFile(this.snapshot); err == nil {
+		log.Printf("Saved snapshot %s", this.snapshot)
+	}
+	return
+}
+
+// OpenLog replays the append-only log at path into the cache and records
+// every later change to it, syncing it as the fsync policy says.
+func (this *Server) OpenLog(path string, fsync string) (err error) {
+	this.log, err = openAppendLog(this.cache, path, fsync)
+	return
+}
+
+// CompactLog rewrites the append-only log from the contents of the cache.
+// Logs are also compacted in the background as they grow.
+func (this *Server) CompactLog() error {
+	if this.log == nil {
+		return errors.New("No log configured")
+	}
+
+	return this.log.Compact()
+}
+
+// CloseLog flushes and syncs the append-only log, if there is one.
+func (this *Server) CloseLog() error {
+	if this.log == nil {
+		return nil
+	}
+
+	return this.log.Close()
+}
+
+// Start accepts connections until the server is shut down, when it returns
+// ErrServerClosed.
+func (this *Server) Start() (err error) {
 	address, err := net.ResolveTCPAddr("tcp", this.addr)
 	if err != nil {
-		log.Fatalf("Cannot resolve address %s: %s", address, err)
+		return fmt.Errorf("Cannot resolve address %s: %w", this.addr, err)
 	}
 
-	this.socket, err = net.ListenTCP("tcp", address)
+	socket, err := net.ListenTCP("tcp", address)
 	if err != nil {
-		log.Fatalf("Cannot bind to address %s: %s", address, err)
+		return fmt.Errorf("Cannot bind to address %s: %w", address, err)
 	}
 
+	this.mutex.Lock()
+	if this.closed() {
+		this.mutex.Unlock()
+		socket.Close()
+		return ErrServerClosed
+	}
+	this.socket = socket
+	this.mutex.Unlock()
+
 	for {
-		conn, err := this.socket.AcceptTCP()
-		if err != nil {
-			log.Fatalf("Cannot accept TCP connection: %s", err)
+		conn, err := socket.AcceptTCP()
+		if this.closed() {
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		} else if errors.Is(err, net.ErrClosed) {
+			return err
+		} else if err != nil {
+			// most likely out of file descriptors, which closing connections
+			// gives back
+			log.Printf("Cannot accept TCP connection: %s", err)
+			time.Sleep(acceptRetry)
+			continue
 		}
 
 		go this.handleConn(conn)
 	}
 }
 
+// Shutdown stops accepting connections, closes the idle ones and waits for
+// the others to finish their current command. Once ctx is done, those which
+// are left are closed too and its error is returned.
+func (this *Server) Shutdown(ctx context.Context) error {
+	this.mutex.Lock()
+	if !this.closed() {
+		atomic.StoreInt32(&this.closing, 1)
+		close(this.done)
+		if this.socket != nil {
+			this.socket.Close()
+		}
+	}
+
+	for session := range this.sessions {
+		if atomic.CompareAndSwapInt32(&session.state, sessionIdle, sessionClosed) {
+			session.conn.Close()
+		}
+	}
+	this.mutex.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		this.mutex.Lock()
+		left := len(this.sessions)
+		this.mutex.Unlock()
+
+		if left == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			this.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop closes the listener and every connection at once.
 func (this *Server) Stop() {
-	this.socket.Close()
-	this.socket = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	this.Shutdown(ctx)
+}
+
+func (this *Server) closed() bool {
+	return atomic.LoadInt32(&this.closing) == 1
+}
+
+func (this *Server) closeSessions() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for session := range this.sessions {
+		atomic.StoreInt32(&session.state, sessionClosed)
+		session.conn.Close()
+	}
+}
+
+// track registers a new session, reporting false if the server is already
+// shutting down, and forgets it once it is over.
+func (this *Server) track(session *session, add bool) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !add {
+		delete(this.sessions, session)
+		return true
+	}
+
+	if this.closed() {
+		return false
+	}
+
+	this.sessions[session] = struct{}{}
+	return true
+}
+
+// lineLength is the size of the read buffer of sessions, which has to hold
+// a whole command line: maxLineLength, unless keys may be so long that
+// commands with them would not fit.
+func (this *Server) lineLength() int {
+	if length := this.maxKeyLength + maxArgumentsLength; length > maxLineLength {
+		return length
+	}
+
+	return maxLineLength
 }
 
 func (this *Server) handleConn(conn net.Conn) {
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	atomic.AddInt64(&this.stats.currConnections, 1)
+	atomic.AddUint64(&this.stats.totalConnections, 1)
+	defer atomic.AddInt64(&this.stats.currConnections, -1)
+
+	session := &session{
+		server: this,
+		conn:   conn,
+		rw:     bufio.NewReadWriter(bufio.NewReaderSize(conn, this.lineLength()), bufio.NewWriter(conn)),
+		parser: new(Parser),
+	}
+	defer session.close()
+
+	if !this.track(session, true) {
+		return
+	}
+	defer this.track(session, false)
 
+	// binary protocol clients always start with the request magic byte
+	session.extendDeadline()
+	if magic, err := session.rw.Peek(1); err == nil && magic[0] == binaryMagicRequest {
+		session.serveBinary()
+	} else {
+		session.serve()
+	}
+}
+
+func (this *session) serve() {
 	for {
+		if !this.idle() {
+			return
+		}
+
 		var buffer []byte
-		buffer, err := rw.ReadSlice('\n')
-		if err == io.EOF {
+		buffer, err := this.rw.ReadSlice('\n')
+		if err == io.EOF && len(buffer) == 0 {
+			return
+		} else if err == bufio.ErrBufferFull {
+			// there is no telling where the next command starts
+			this.handleInputError("Line too long")
+			this.rw.Write(this.response.Bytes())
+			this.rw.Flush()
+			this.broken(err)
 			return
 		} else if err != nil {
-			log.Fatalf("Cannot read TCP connection data: %s", err)
+			this.broken(err)
+			return
 		}
 
-		this.parser.cmd = bytes.Trim(buffer[:], "\r\n")
-
-		if bytes.HasPrefix(buffer, cmdSet) {
-			log.Printf("Received «set» command: \"%s\"", this.parser.cmd)
-			this.runSetCmd(rw)
-		} else if bytes.HasPrefix(buffer, cmdAdd) {
-			log.Printf("Received «add» command: \"%s\"", this.parser.cmd)
-			this.runAddCmd(rw)
-		} else if bytes.HasPrefix(buffer, cmdReplace) {
-			log.Printf("Received «replace» command: \"%s\"", this.parser.cmd)
-			this.runReplaceCmd(rw)
-		} else if bytes.HasPrefix(buffer, cmdAppend) {
-			log.Printf("Received «append» command: \"%s\"", this.parser.cmd)
-			this.runAppendCmd(rw)
-		} else if bytes.HasPrefix(buffer, cmdPrepend) {
-			log.Printf("Received «prepend» command: \"%s\"", this.parser.cmd)
-			this.runPrependCmd(rw)
-		} else if bytes.HasPrefix(buffer, cmdCas) {
-			log.Printf("Received «cas» command: \"%s\"", this.parser.cmd)
-			this.runCasCmd(rw)
-		} else if bytes.HasPrefix(buffer, cmdGets) {
-			log.Printf("Received «gets» command: %s", this.parser.cmd)
-			this.runGetsCmd()
-		} else if bytes.HasPrefix(buffer, cmdGet) {
-			log.Printf("Received «get» command: %s", this.parser.cmd)
-			this.runGetCmd()
-		} else if bytes.HasPrefix(buffer, cmdDelete) {
-			log.Printf("Received «delete» command: %s", this.parser.cmd)
-			this.runDeleteCmd()
-		} else if len(buffer) == 1 {
+		if !this.active() {
+			return
+		}
+
+		this.line = append(this.line[:0], bytes.Trim(buffer, "\r\n")...)
+		this.parser.cmd = this.line
+		this.commands++
+
+		// a bare newline ends the session
+		if len(buffer) == 1 {
 			return
-		} else {
-			log.Printf("Received nonexistent command «%s»", this.parser.cmd)
-			this.handleError()
 		}
 
-		if _, err = rw.Write([]byte(this.response)); err != nil {
+		if !this.dispatch() {
 			return
 		}
 
-		if err = rw.Flush(); err != nil {
+		if this.err != nil {
+			this.broken(this.err)
 			return
 		}
 
-		this.response = ""
+		if !this.noreply {
+			if _, err = this.rw.Write(this.response.Bytes()); err != nil {
+				this.broken(err)
+				return
+			}
+
+			if err = this.rw.Flush(); err != nil {
+				this.broken(err)
+				return
+			}
+		}
+
+		this.response.Reset()
+		this.noreply = false
 	}
 }
 
-func (this *Server) runSetCmd(rw *bufio.ReadWriter) {
-	key, priority, flags, exptime, size, ok := this.parser.ParseSetCmd()
-	if !ok {
-		log.Printf("An error occured while parsing «set» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
+// idle marks the session as waiting for its next command, unless the client
+// has already sent one, and reports whether it should go on, which it
+// should not once the server is shutting down.
+func (this *session) idle() bool {
+	if this.rw.Reader.Buffered() == 0 {
+		atomic.StoreInt32(&this.state, sessionIdle)
+	}
+
+	this.extendDeadline()
+	return !this.server.closed()
+}
+
+// active marks the session as running a command, reporting false if
+// Shutdown closed it first.
+func (this *session) active() bool {
+	this.extendDeadline()
+	return atomic.LoadInt32(&this.state) == sessionActive ||
+		atomic.CompareAndSwapInt32(&this.state, sessionIdle, sessionActive)
+}
+
+func (this *session) extendDeadline() {
+	if timeout := this.server.idleTimeout; timeout > 0 {
+		this.conn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// broken reports a network or protocol error, after which the session
+// ends. It only ever takes down the connection of the session.
+func (this *session) broken(err error) {
+	if atomic.LoadInt32(&this.state) == sessionClosed {
+		// closed by Shutdown
 		return
 	}
 
-	value, err := ioutil.ReadAll(io.LimitReader(rw, int64(size)))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Printf("Connection from %s timed out", this.conn.RemoteAddr())
+		atomic.AddUint64(&this.server.stats.idleKicks, 1)
+		return
+	}
+
+	log.Printf("Connection from %s failed: %s", this.conn.RemoteAddr(), err)
+	atomic.AddUint64(&this.server.stats.connectionErrors, 1)
+}
+
+func (this *session) close() {
+	log.Printf("Closing connection from %s after %d commands", this.conn.RemoteAddr(), this.commands)
+	this.conn.Close()
+}
+
+// readValue reads a data block into a value of exactly its size, as the
+// spare capacity of a value counts against the cache budget too. A failed
+// read ends the session, as its connection is broken.
+func (this *session) readValue(size uint64) (value []byte, err error) {
+	if size > uint64(this.server.maxValueLength) {
+		// not preallocated, as the client may never send that much
+		value, err = ioutil.ReadAll(io.LimitReader(this.rw, int64(size)))
+		if err == nil && uint64(len(value)) != size {
+			err = io.ErrUnexpectedEOF
+		}
+	} else {
+		value = make([]byte, size)
+		_, err = io.ReadFull(this.rw, value)
+	}
+
 	if err != nil {
+		this.err = err
+	}
+	return
+}
+
+// readData reads the data block of a storage command for key, which ends
+// with \r\n. Blocks which cannot be stored are answered with CLIENT_ERROR
+// and discarded, so that the next command is read from where it starts. Like
+// any other reply, the error is not sent if noreply is already set, as quiet
+// clients never read it.
+func (this *session) readData(key []byte, size uint64) (value []byte, ok bool) {
+	if size > uint64(this.server.maxValueLength) {
+		log.Printf("Rejected value of %d bytes for key=\"%s\"", size, key)
+		this.rejectData(size, "Object too large for cache")
 		return
 	}
 
-	log.Printf("Parsed «set» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", key, value, priority, flags, exptime)
+	if !this.validKeys(key) {
+		this.skipData(size)
+		return
+	}
+
+	value, err := this.readValue(size)
+	if err != nil {
+		return
+	}
 
-	this.cache.Set(string(key[:]), value, priority, flags, exptime)
-	this.response = msgStored
+	ok = this.readTerminator()
+	return
 }
 
-func (this *Server) runAddCmd(rw *bufio.ReadWriter) {
-	key, priority, flags, exptime, size, ok := this.parser.ParseAddCmd()
-	if !ok {
-		log.Printf("An error occured while parsing «add» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
+// rejectData answers with CLIENT_ERROR and discards the data block. The
+// client hears of it before sending what may be gigabytes.
+func (this *session) rejectData(size uint64, reason string) {
+	this.handleInputError(reason)
+	if this.noreply {
+		this.skipData(size)
 		return
 	}
 
-	value, err := ioutil.ReadAll(io.LimitReader(rw, int64(size)))
+	this.rw.Write(this.response.Bytes())
+	this.response.Reset()
+	if err := this.rw.Flush(); err != nil {
+		this.err = err
+		return
+	}
+
+	this.skipData(size)
+}
+
+// skipData discards a data block and its terminator without holding it.
+func (this *session) skipData(size uint64) {
+	if size > math.MaxInt64-2 {
+		this.err = fmt.Errorf("Cannot skip data block of %d bytes", size)
+		return
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, this.rw, int64(size)+2); err != nil {
+		this.err = err
+	}
+}
+
+// readTerminator consumes the \r\n which ends a data block, answering with
+// CLIENT_ERROR and discarding the rest of the line if it is missing.
+func (this *session) readTerminator() bool {
+	terminator, err := this.rw.Peek(2)
 	if err != nil {
+		this.err = err
+		return false
+	}
+
+	if !bytes.Equal(terminator, []byte("\r\n")) {
+		this.handleInputError("Bad data chunk")
+
+		// like in memcached, the rest of the line goes too, rather than
+		// being read as commands
+		for {
+			if _, err = this.rw.ReadSlice('\n'); err != bufio.ErrBufferFull {
+				break
+			}
+		}
+		if err != nil {
+			this.err = err
+		}
+		return false
+	}
+
+	this.rw.Discard(2)
+	return true
+}
+
+// validKeys answers with CLIENT_ERROR unless every key is valid.
+func (this *session) validKeys(keys ...[]byte) bool {
+	for _, key := range keys {
+		if reason := validateKey(key, this.server.maxKeyLength); reason != "" {
+			log.Printf("Rejected key=%q: %s", key, reason)
+			this.handleInputError(reason)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (this *session) runSetCmd(request *textRequest) {
+	this.noreply = request.noreply
+	value, ok := this.readData(request.key, request.size)
+	if !ok {
 		return
 	}
 
-	log.Printf("Parsed «add» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", key, value, priority, flags, exptime)
-	if ok = this.cache.Add(string(key[:]), value, priority, flags, exptime); ok {
-		this.response = msgStored
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	log.Printf("Parsed «set» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", request.key, value, request.priority, request.flags, request.exptime)
+
+	if this.readOnly() {
+		return
+	}
+
+	if _, ok = this.server.cache.Set(string(request.key[:]), value, request.priority, request.flags, request.exptime); ok {
+		this.response.WriteString(msgStored)
 	} else {
-		this.response = msgNotStored
+		this.response.WriteString(msgNotStored)
 	}
 }
 
-func (this *Server) runReplaceCmd(rw *bufio.ReadWriter) {
-	key, priority, flags, exptime, size, ok := this.parser.ParseReplaceCmd()
+func (this *session) runAddCmd(request *textRequest) {
+	this.noreply = request.noreply
+	value, ok := this.readData(request.key, request.size)
 	if !ok {
-		log.Printf("An error occured while parsing «replace» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
 		return
 	}
 
-	value, err := ioutil.ReadAll(io.LimitReader(rw, int64(size)))
-	if err != nil {
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	log.Printf("Parsed «add» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", request.key, value, request.priority, request.flags, request.exptime)
+	if this.readOnly() {
 		return
 	}
 
-	log.Printf("Parsed «replace» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", key, value, priority, flags, exptime)
-	if ok = this.cache.Replace(string(key[:]), value, priority, flags, exptime); ok {
-		this.response = msgStored
+	if _, ok = this.server.cache.Add(string(request.key[:]), value, request.priority, request.flags, request.exptime); ok {
+		this.response.WriteString(msgStored)
 	} else {
-		this.response = msgNotStored
+		this.response.WriteString(msgNotStored)
 	}
 }
 
-func (this *Server) runAppendCmd(rw *bufio.ReadWriter) {
-	key, priority, flags, exptime, size, ok := this.parser.ParseAppendCmd()
+func (this *session) runReplaceCmd(request *textRequest) {
+	this.noreply = request.noreply
+	value, ok := this.readData(request.key, request.size)
 	if !ok {
-		log.Printf("An error occured while parsing «append» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
 		return
 	}
 
-	value, err := ioutil.ReadAll(io.LimitReader(rw, int64(size)))
-	if err != nil {
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	log.Printf("Parsed «replace» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", request.key, value, request.priority, request.flags, request.exptime)
+	if this.readOnly() {
 		return
 	}
 
-	log.Printf("Parsed «append» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", key, value, priority, flags, exptime)
-	if ok = this.cache.Append(string(key[:]), value, priority, flags, exptime); ok {
-		this.response = msgStored
+	if _, ok = this.server.cache.Replace(string(request.key[:]), value, request.priority, request.flags, request.exptime); ok {
+		this.response.WriteString(msgStored)
 	} else {
-		this.response = msgNotStored
+		this.response.WriteString(msgNotStored)
 	}
 }
 
-func (this *Server) runPrependCmd(rw *bufio.ReadWriter) {
-	key, priority, flags, exptime, size, ok := this.parser.ParsePrependCmd()
+func (this *session) runAppendCmd(request *textRequest) {
+	this.noreply = request.noreply
+	value, ok := this.readData(request.key, request.size)
 	if !ok {
-		log.Printf("An error occured while parsing «prepend» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
 		return
 	}
 
-	value, err := ioutil.ReadAll(io.LimitReader(rw, int64(size)))
-	if err != nil {
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	log.Printf("Parsed «append» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", request.key, value, request.priority, request.flags, request.exptime)
+	if this.readOnly() {
 		return
 	}
 
-	log.Printf("Parsed «prepend» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", key, value, priority, flags, exptime)
-	if ok = this.cache.Prepend(string(key[:]), value, priority, flags, exptime); ok {
-		this.response = msgStored
+	if _, ok = this.server.cache.Append(string(request.key[:]), value, request.priority, request.flags, request.exptime); ok {
+		this.response.WriteString(msgStored)
 	} else {
-		this.response = msgNotStored
+		this.response.WriteString(msgNotStored)
 	}
 }
 
-func (this *Server) runCasCmd(rw *bufio.ReadWriter) {
-	key, priority, flags, exptime, size, casid, ok := this.parser.ParseCasCmd()
+func (this *session) runPrependCmd(request *textRequest) {
+	this.noreply = request.noreply
+	value, ok := this.readData(request.key, request.size)
 	if !ok {
-		log.Printf("An error occured while parsing «cas» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
 		return
 	}
 
-	value, err := ioutil.ReadAll(io.LimitReader(rw, int64(size)))
-	if err != nil {
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	log.Printf("Parsed «prepend» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\"", request.key, value, request.priority, request.flags, request.exptime)
+	if this.readOnly() {
 		return
 	}
 
-	log.Printf("Parsed «cas» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\", casid=\"%d\"", key, value, priority, flags, exptime, casid)
-	if entry, ok := this.cache.CheckAndStore(string(key[:]), value, priority, flags, exptime, casid); ok {
-		this.response = msgStored
+	if _, ok = this.server.cache.Prepend(string(request.key[:]), value, request.priority, request.flags, request.exptime); ok {
+		this.response.WriteString(msgStored)
+	} else {
+		this.response.WriteString(msgNotStored)
+	}
+}
+
+func (this *session) runCasCmd(request *textRequest) {
+	this.noreply = request.noreply
+	value, ok := this.readData(request.key, request.size)
+	if !ok {
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdSet, 1)
+	log.Printf("Parsed «cas» command arguments: key=\"%s\", value=\"%s\", priority=\"%d\", flags=\"%d\", exptime=\"%d\", casid=\"%d\"", request.key, value, request.priority, request.flags, request.exptime, request.casid)
+	if this.readOnly() {
+		return
+	}
+
+	if entry, ok := this.server.cache.CheckAndStore(string(request.key[:]), value, request.priority, request.flags, request.exptime, request.casid); ok {
+		this.response.WriteString(msgStored)
 	} else {
 		if entry == nil {
-			this.response = msgNotFound
+			this.response.WriteString(msgNotFound)
 		} else {
-			this.response = msgExists
+			this.response.WriteString(msgExists)
 		}
 	}
 }
 
-func (this *Server) runGetCmd() {
-	key, ok := this.parser.ParseGetCmd()
-	if !ok {
-		log.Printf("An error occured while parsing «get» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
+func (this *session) runGetCmd(request *textRequest) {
+	if !this.validKeys(request.keys...) {
 		return
 	}
 
-	log.Printf("Parsed «get» command arguments: key=\"%s\"", key)
+	log.Printf("Parsed «get» command arguments: keys=\"%s\"", request.keys)
 
-	value, flags, size, ok := this.cache.Get(string(key[:]))
-	if ok {
-		log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, key)
-		this.response = fmt.Sprintf("VALUE %s %d %d \r\n%s\r\nEND\r\n", key, flags, size, value)
+	for _, key := range request.keys {
+		value, flags, size, ok := this.server.cache.Get(string(key[:]))
+		atomic.AddUint64(&this.server.stats.cmdGet, 1)
+		if ok {
+			atomic.AddUint64(&this.server.stats.getHits, 1)
+			log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, key)
+			fmt.Fprintf(&this.response, "VALUE %s %d %d \r\n%s\r\n", key, flags, size, value)
+		} else {
+			atomic.AddUint64(&this.server.stats.getMisses, 1)
+			log.Printf("Cache miss for key=\"%s\"", key)
+		}
+	}
+	this.response.Write(strEnd)
+}
+
+func (this *session) runGetsCmd(request *textRequest) {
+	if !this.validKeys(request.keys...) {
+		return
+	}
+
+	log.Printf("Parsed «gets» command arguments: keys=\"%s\"", request.keys)
+
+	for _, key := range request.keys {
+		value, flags, size, casid, ok := this.server.cache.Gets(string(key[:]))
+		atomic.AddUint64(&this.server.stats.cmdGet, 1)
+		if ok {
+			atomic.AddUint64(&this.server.stats.getHits, 1)
+			log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, key)
+			fmt.Fprintf(&this.response, "VALUE %s %d %d %d \r\n%s\r\n", key, flags, size, casid, value)
+		} else {
+			atomic.AddUint64(&this.server.stats.getMisses, 1)
+			log.Printf("Cache miss for key=\"%s\"", key)
+		}
+	}
+	this.response.Write(strEnd)
+}
+
+func (this *session) runGatCmd(request *textRequest) {
+	if !this.validKeys(request.keys...) {
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdTouch, 1)
+	log.Printf("Parsed «gat» command arguments: exptime=\"%d\", keys=\"%s\"", request.exptime, request.keys)
+
+	if this.readOnly() {
+		return
+	}
+
+	for _, key := range request.keys {
+		value, flags, size, _, ok := this.server.cache.GetAndTouch(string(key[:]), request.exptime)
+		atomic.AddUint64(&this.server.stats.cmdGet, 1)
+		if ok {
+			atomic.AddUint64(&this.server.stats.getHits, 1)
+			log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, key)
+			fmt.Fprintf(&this.response, "VALUE %s %d %d \r\n%s\r\n", key, flags, size, value)
+		} else {
+			atomic.AddUint64(&this.server.stats.getMisses, 1)
+			log.Printf("Cache miss for key=\"%s\"", key)
+		}
+	}
+	this.response.Write(strEnd)
+}
+
+func (this *session) runGatsCmd(request *textRequest) {
+	if !this.validKeys(request.keys...) {
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdTouch, 1)
+	log.Printf("Parsed «gats» command arguments: exptime=\"%d\", keys=\"%s\"", request.exptime, request.keys)
+
+	if this.readOnly() {
+		return
+	}
+
+	for _, key := range request.keys {
+		value, flags, size, casid, ok := this.server.cache.GetAndTouch(string(key[:]), request.exptime)
+		atomic.AddUint64(&this.server.stats.cmdGet, 1)
+		if ok {
+			atomic.AddUint64(&this.server.stats.getHits, 1)
+			log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, key)
+			fmt.Fprintf(&this.response, "VALUE %s %d %d %d \r\n%s\r\n", key, flags, size, casid, value)
+		} else {
+			atomic.AddUint64(&this.server.stats.getMisses, 1)
+			log.Printf("Cache miss for key=\"%s\"", key)
+		}
+	}
+	this.response.Write(strEnd)
+}
+
+func (this *session) runTouchCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
+		return
+	}
+
+	atomic.AddUint64(&this.server.stats.cmdTouch, 1)
+	log.Printf("Parsed «touch» command arguments: key=\"%s\", exptime=\"%d\"", request.key, request.exptime)
+
+	if this.readOnly() {
+		return
+	}
+
+	if this.server.cache.Touch(string(request.key[:]), request.exptime) {
+		log.Printf("Touched value for key=\"%s\"", request.key)
+		this.response.WriteString(msgTouched)
 	} else {
-		log.Printf("Cache miss for key=\"%s\"", key)
-		this.response = string(strEnd)
+		log.Printf("Cannot touch value for key=\"%s\"", request.key)
+		this.response.WriteString(msgNotFound)
 	}
 }
 
-func (this *Server) runGetsCmd() {
-	key, ok := this.parser.ParseGetsCmd()
-	if !ok {
-		log.Printf("An error occured while parsing «gets» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
+func (this *session) runDeleteCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
 		return
 	}
 
-	log.Printf("Parsed «gets» command arguments: key=\"%s\"", key)
+	log.Printf("Parsed «delete» command arguments: key=\"%s\", noreply=\"%t\"", request.key, request.noreply)
+	this.noreply = request.noreply
+
+	if this.readOnly() {
+		return
+	}
 
-	value, flags, size, casid, ok := this.cache.Gets(string(key[:]))
+	ok := this.server.cache.Delete(string(request.key[:]))
 	if ok {
-		log.Printf("Retrieved value=\"%s\" for key=\"%s\"", value, key)
-		this.response = fmt.Sprintf("VALUE %s %d %d %d \r\n%s\r\nEND\r\n", key, flags, size, casid, value)
+		log.Printf("Deleted value for key=\"%s\"", request.key)
+		this.response.WriteString(msgDeleted)
 	} else {
-		log.Printf("Cache miss for key=\"%s\"", key)
+		log.Printf("Cannot delete value for key=\"%s\"", request.key)
+		this.response.WriteString(msgNotFound)
 	}
 }
 
-func (this *Server) runDeleteCmd() {
-	key, ok := this.parser.ParseDeleteCmd()
-	if !ok {
-		log.Printf("An error occured while parsing «delete» command: cannot parse %s", this.parser.failedToken)
-		this.handleInputError(fmt.Sprintf("Cannot parse %s", this.parser.failedToken))
+func (this *session) runIncrCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
+		return
+	}
+
+	log.Printf("Parsed «incr» command arguments: key=\"%s\", delta=\"%d\"", request.key, request.delta)
+
+	if this.readOnly() {
+		return
+	}
+
+	entry, value, ok := this.server.cache.Incr(string(request.key[:]), request.delta)
+	this.handleArithmeticResult(request.key, entry, value, ok)
+}
+
+func (this *session) runDecrCmd(request *textRequest) {
+	if !this.validKeys(request.key) {
 		return
 	}
 
-	log.Printf("Parsed «delete» command arguments: key=\"%s\"", key)
+	log.Printf("Parsed «decr» command arguments: key=\"%s\", delta=\"%d\"", request.key, request.delta)
 
-	ok = this.cache.Delete(string(key[:]))
+	if this.readOnly() {
+		return
+	}
+
+	entry, value, ok := this.server.cache.Decr(string(request.key[:]), request.delta)
+	this.handleArithmeticResult(request.key, entry, value, ok)
+}
+
+func (this *session) handleArithmeticResult(key []byte, entry *Entry, value uint64, ok bool) {
 	if ok {
-		log.Printf("Deleted value for key=\"%s\"", key)
-		this.response = msgDeleted
+		log.Printf("Updated value=\"%d\" for key=\"%s\"", value, key)
+		fmt.Fprintf(&this.response, "%d\r\n", value)
+	} else if entry == nil {
+		log.Printf("Cache miss for key=\"%s\"", key)
+		this.response.WriteString(msgNotFound)
 	} else {
-		log.Printf("Cannot delete value for key=\"%s\"", key)
-		this.response = msgNotFound
+		log.Printf("Cannot update non-numeric value for key=\"%s\"", key)
+		this.handleInputError(errNonNumeric)
 	}
 }
 
-func (this *Server) handleError() {
-	this.response = msgError
+func (this *session) runFlushAllCmd(request *textRequest) {
+	atomic.AddUint64(&this.server.stats.cmdFlush, 1)
+	log.Printf("Parsed «flush_all» command arguments: delay=\"%d\", noreply=\"%t\"", request.delay, request.noreply)
+
+	if this.readOnly() {
+		return
+	}
+
+	this.server.cache.Flush(request.delay)
+	this.response.WriteString(msgOk)
+	this.noreply = request.noreply
+}
+
+func (this *session) runStatsCmd(request *textRequest) {
+	log.Printf("Parsed «stats» command arguments: group=\"%s\"", request.group)
+
+	stats, ok := this.server.collectStats(string(request.group))
+	if !ok {
+		log.Printf("Unknown «stats» group «%s»", request.group)
+		this.handleError()
+		return
+	}
+
+	for _, stat := range stats {
+		fmt.Fprintf(&this.response, "%s %s %v\r\n", strStat, stat.name, stat.value)
+	}
+	this.response.Write(strEnd)
+}
+
+type stat struct {
+	name  string
+	value interface{}
+}
+
+// collectStats returns the statistics of a «stats» group in reporting order,
+// the empty group being the general one.
+func (this *Server) collectStats(group string) (stats []stat, ok bool) {
+	cacheStats := this.cache.Stats()
+	counters := &this.stats
+
+	switch group {
+	case "":
+		stats = []stat{
+			{"pid", os.Getpid()},
+			{"uptime", int64(time.Since(this.started).Seconds())},
+			{"time", time.Now().Unix()},
+			{"version", version},
+			{"curr_connections", atomic.LoadInt64(&counters.currConnections)},
+			{"total_connections", atomic.LoadUint64(&counters.totalConnections)},
+			{"connection_errors", atomic.LoadUint64(&counters.connectionErrors)},
+			{"idle_kicks", atomic.LoadUint64(&counters.idleKicks)},
+			{"cmd_get", atomic.LoadUint64(&counters.cmdGet)},
+			{"cmd_set", atomic.LoadUint64(&counters.cmdSet)},
+			{"cmd_touch", atomic.LoadUint64(&counters.cmdTouch)},
+			{"cmd_flush", atomic.LoadUint64(&counters.cmdFlush)},
+			{"get_hits", atomic.LoadUint64(&counters.getHits)},
+			{"get_misses", atomic.LoadUint64(&counters.getMisses)},
+			{"curr_items", cacheStats.Items},
+			{"total_items", cacheStats.TotalItems},
+			{"evictions", cacheStats.Evictions},
+			{"reclaimed", cacheStats.Reclaimed},
+			{"admission_rejections", cacheStats.Rejections},
+			{"bytes", cacheStats.Bytes},
+			{"bytes_payload", cacheStats.PayloadBytes},
+			{"bytes_overhead", cacheStats.OverheadBytes},
+			{"limit_maxbytes", cacheStats.MaxBytes},
+		}
+		stats = append(stats, this.replicationStats()...)
+	case "items":
+		stats = []stat{
+			{"curr_items", cacheStats.Items},
+			{"total_items", cacheStats.TotalItems},
+			{"evictions", cacheStats.Evictions},
+			{"reclaimed", cacheStats.Reclaimed},
+			{"admission_rejections", cacheStats.Rejections},
+		}
+	case "priorities":
+		priorities := make([]uint64, 0, len(cacheStats.Priorities))
+		for priority := range cacheStats.Priorities {
+			priorities = append(priorities, priority)
+		}
+		sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+
+		for _, priority := range priorities {
+			stats = append(stats,
+				stat{fmt.Sprintf("priority:%d:items", priority), cacheStats.Priorities[priority].Items},
+				stat{fmt.Sprintf("priority:%d:bytes", priority), cacheStats.Priorities[priority].Bytes})
+		}
+	case "replication":
+		stats = this.replicationStats()
+	case "cluster":
+		stats = this.clusterStats()
+	case "slabs":
+		malloced := 0
+		for i, class := range cacheStats.Slabs {
+			if class.Pages == 0 {
+				continue
+			}
+
+			stats = append(stats,
+				stat{fmt.Sprintf("%d:chunk_size", i+1), class.ChunkSize},
+				stat{fmt.Sprintf("%d:total_pages", i+1), class.Pages},
+				stat{fmt.Sprintf("%d:total_chunks", i+1), class.Chunks},
+				stat{fmt.Sprintf("%d:used_chunks", i+1), class.UsedChunks},
+				stat{fmt.Sprintf("%d:free_chunks", i+1), class.Chunks - class.UsedChunks})
+			malloced += class.Pages * slabPageSize
+		}
+		stats = append(stats, stat{"total_malloced", malloced})
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
+
+func (this *session) runSaveCmd(request *textRequest) {
+	if err := this.server.SaveSnapshot(); err != nil {
+		log.Printf("Cannot save snapshot: %s", err)
+		this.handleServerError(err.Error())
+		return
+	}
+
+	this.response.WriteString(msgOk)
+}
+
+func (this *session) handleError() {
+	this.response.WriteString(msgError)
+}
+
+func (this *session) handleInputError(errorStr string) {
+	fmt.Fprintf(&this.response, "CLIENT_ERROR %s\r\n", errorStr)
 }
 
-func (this *Server) handleInputError(errorStr string) {
-	this.response = fmt.Sprintf("CLIENT_ERROR %s\r\n", errorStr)
+func (this *session) handleServerError(errorStr string) {
+	fmt.Fprintf(&this.response, "SERVER_ERROR %s\r\n", errorStr)
 }
@@ -1,16 +1,108 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/ilyakhokhryakov/whatever"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
 	verbose := flag.Bool("v", false, "enable verbose mode")
 	addr := flag.String("a", "0.0.0.0:9336", "address to listen")
-	maxLength := flag.Int("m", 4*1024*1024, "max cache size")
+	maxLength := flag.Int("m", 4*1024*1024, "max cache size in bytes, keys and entry overhead included")
+	evictionPolicy := flag.String("e", "priority", "eviction policy: priority, lru, lfu, fifo or gds (priority is the recompute cost)")
+	tinyLFU := flag.Bool("t", false, "enable TinyLFU admission filter")
+	slabs := flag.Bool("s", false, "store values in reusable slab chunks to reduce GC pressure")
+	snapshot := flag.String("f", "", "snapshot file, loaded at startup and written on shutdown or «save»")
+	appendLog := flag.String("l", "", "append-only log file, replayed at startup")
+	fsync := flag.String("y", whatever.FsyncEverySecond, "fsync policy of the log: always, everysec or no")
+	primary := flag.String("r", "", "address of a primary to run as its read-only replica")
+	advertise := flag.String("n", "", "address other cluster members reach this server at, enables cluster mode")
+	seeds := flag.String("c", "", "comma separated members of the cluster to join")
+	maxKeyLength := flag.Int("k", 1024, "max key length in bytes")
+	maxValueLength := flag.Int("I", 1024*1024, "max value length in bytes")
+	idleTimeout := flag.Duration("i", 0, "close connections idle for that long, 0 to never")
+	drain := flag.Duration("w", 10*time.Second, "how long to wait for open connections on shutdown")
 	flag.Parse()
 
+	newPolicy, err := whatever.EvictionPolicyFactory(*evictionPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	server := whatever.NewServer(*addr, *verbose, *maxLength)
-	server.Start()
+	server.SetEvictionPolicy(newPolicy)
+	server.SetIdleTimeout(*idleTimeout)
+	server.SetMaxKeyLength(*maxKeyLength)
+	server.SetMaxValueLength(*maxValueLength)
+	if *tinyLFU {
+		// sized for 64 byte entries on average, erring on the side of precision
+		server.SetAdmissionPolicy(func() whatever.AdmissionPolicy {
+			return whatever.NewTinyLFU(*maxLength / 64 / whatever.DefaultShardCount)
+		})
+	}
+	if *slabs {
+		server.EnableSlabs()
+	}
+	if *snapshot != "" {
+		server.SetSnapshotFile(*snapshot)
+		if err := server.LoadSnapshot(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *appendLog != "" {
+		if err := server.OpenLog(*appendLog, *fsync); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *primary != "" {
+		server.ReplicateFrom(*primary)
+	}
+	if *advertise != "" {
+		var members []string
+		if *seeds != "" {
+			members = strings.Split(*seeds, ",")
+		}
+		server.JoinCluster(*advertise, members...)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		if *advertise != "" {
+			if err := server.LeaveCluster(); err != nil {
+				log.Print(err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *drain)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Closed connections still running a command: %s", err)
+		}
+
+		if *snapshot != "" {
+			if err := server.SaveSnapshot(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := server.CloseLog(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if err := server.Start(); err != whatever.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
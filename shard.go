@@ -0,0 +1,560 @@
+package whatever
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shard is an independently locked part of the cache. The byte budget and
+// the casid counter are shared through the cache, everything else is owned
+// by the shard and guarded by its mutex.
+type shard struct {
+	cache     *Cache
+	policy    EvictionPolicy
+	admission AdmissionPolicy
+	slabs     *slabAllocator
+	m         map[string]*Entry
+	mutex     sync.Mutex
+	length    int
+	payload   int
+
+	priorities map[uint64]*PriorityStats
+	total      uint64
+	evictions  uint64
+	reclaimed  uint64
+	rejections uint64
+}
+
+func newShard(cache *Cache) *shard {
+	shard := new(shard)
+	shard.cache = cache
+	shard.m = make(map[string]*Entry)
+	shard.policy = NewPriorityPolicy()
+	shard.priorities = make(map[uint64]*PriorityStats)
+
+	return shard
+}
+
+func (this *shard) Set(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.recordAccess(key)
+
+	entry, found := this.lookup(key)
+	if found {
+		this.update(entry, value, priority)
+		entry.flags = flags
+		entry.expires = expiration(exptime)
+		entry.casid = this.cache.next()
+	} else if this.admit(key, footprint(key, value, this.policy)) {
+		entry = &Entry{key: key, value: value, priority: priority, flags: flags, expires: expiration(exptime)}
+		this.insert(entry)
+	} else {
+		return
+	}
+
+	this.record(journalStore, entry)
+	return this.copy(entry), true
+}
+
+func (this *shard) Add(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.recordAccess(key)
+
+	if _, found := this.lookup(key); found || !this.admit(key, footprint(key, value, this.policy)) {
+		return
+	}
+
+	entry := &Entry{key: key, value: value, priority: priority, flags: flags, expires: expiration(exptime)}
+	this.insert(entry)
+	this.record(journalStore, entry)
+
+	return this.copy(entry), true
+}
+
+func (this *shard) Replace(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok := this.lookup(key)
+	if ok {
+		this.update(entry, value, priority)
+		entry.flags = flags
+		entry.expires = expiration(exptime)
+		entry.casid = this.cache.next()
+		this.record(journalStore, entry)
+		stored = this.copy(entry)
+	}
+
+	return
+}
+
+func (this *shard) Append(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok := this.lookup(key)
+	if ok {
+		this.update(entry, append(entry.value, value...), priority)
+		entry.casid = this.cache.next()
+		this.record(journalStore, entry)
+		stored = this.copy(entry)
+	}
+
+	return
+}
+
+func (this *shard) Prepend(key string, value []byte, priority uint64, flags uint64, exptime uint64) (stored Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok := this.lookup(key)
+	if ok {
+		this.update(entry, append(value, entry.value...), priority)
+		entry.casid = this.cache.next()
+		this.record(journalStore, entry)
+		stored = this.copy(entry)
+	}
+
+	return
+}
+
+func (this *shard) CheckAndStore(key string, value []byte, priority uint64, flags uint64, exptime uint64, casid uint64) (entry *Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	current, ok := this.lookup(key)
+	if !ok {
+		return
+	}
+
+	if current.casid == casid {
+		this.update(current, value, priority)
+		current.flags = flags
+		current.expires = expiration(exptime)
+		current.casid = this.cache.next()
+		this.record(journalStore, current)
+	} else {
+		ok = false
+	}
+
+	stored := this.copy(current)
+	return &stored, ok
+}
+
+func (this *shard) arithmetic(key string, delta uint64, decrement bool) (entry *Entry, value uint64, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	current, found := this.lookup(key)
+	if !found {
+		return
+	}
+
+	stored := this.copy(current)
+	entry = &stored
+
+	value, err := strconv.ParseUint(string(current.value), 10, 64)
+	if err != nil {
+		return
+	}
+
+	if !decrement {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+
+	this.update(current, []byte(strconv.FormatUint(value, 10)), current.priority)
+	current.casid = this.cache.next()
+	this.record(journalStore, current)
+
+	stored = this.copy(current)
+	ok = true
+	return
+}
+
+func (this *shard) Gets(key string) (value []byte, flags uint64, size uint64, casid uint64, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.recordAccess(key)
+
+	entry, ok := this.lookup(key)
+	if ok {
+		this.access(entry)
+		value = this.out(entry.value)
+		flags = entry.flags
+		size = uint64(len(value))
+		casid = entry.casid
+	}
+
+	return
+}
+
+func (this *shard) Touch(key string, exptime uint64) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok := this.lookup(key)
+	if ok {
+		entry.expires = expiration(exptime)
+		this.record(journalTouch, entry)
+	}
+
+	return ok
+}
+
+func (this *shard) GetAndTouch(key string, exptime uint64) (value []byte, flags uint64, size uint64, casid uint64, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.recordAccess(key)
+
+	entry, ok := this.lookup(key)
+	if ok {
+		this.access(entry)
+		entry.expires = expiration(exptime)
+		this.record(journalTouch, entry)
+		value = this.out(entry.value)
+		flags = entry.flags
+		size = uint64(len(value))
+		casid = entry.casid
+	}
+
+	return
+}
+
+func (this *shard) Peek(key string) (entry Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	stored, ok := this.lookup(key)
+	if ok {
+		entry = this.copy(stored)
+	}
+
+	return
+}
+
+func (this *shard) MetaGet(key string, touch bool, exptime uint64) (entry Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.recordAccess(key)
+
+	stored, ok := this.lookup(key)
+	if ok {
+		entry = this.copy(stored)
+		this.access(stored)
+		if touch {
+			stored.expires = expiration(exptime)
+			entry.expires = stored.expires
+			this.record(journalTouch, stored)
+		}
+	}
+
+	return
+}
+
+func (this *shard) CheckAndDelete(key string, casid uint64) (entry *Entry, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok = this.lookup(key)
+	if ok {
+		if entry.casid == casid {
+			this.remove(entry)
+			this.record(journalDelete, entry)
+		} else {
+			ok = false
+		}
+	}
+
+	return
+}
+
+func (this *shard) Delete(key string) bool {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	entry, ok := this.lookup(key)
+	if ok {
+		this.remove(entry)
+		this.record(journalDelete, entry)
+	}
+
+	return ok
+}
+
+// clear removes every entry, the caller holding the mutex.
+func (this *shard) clear() {
+	for _, entry := range this.m {
+		this.remove(entry)
+	}
+}
+
+func (this *shard) setEvictionPolicy(policy EvictionPolicy) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	// entries are charged for the handle of the policy tracking them
+	for _, entry := range this.m {
+		this.account(entry, -1)
+		this.policy.OnRemove(entry)
+	}
+
+	this.policy = policy
+	for _, entry := range this.m {
+		policy.OnInsert(entry)
+		this.account(entry, 1)
+	}
+}
+
+// enableSlabs moves every stored value into slab chunks.
+func (this *shard) enableSlabs() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.slabs != nil {
+		return
+	}
+
+	this.slabs = newSlabAllocator()
+	for _, entry := range this.m {
+		this.account(entry, -1)
+		entry.value = this.own(entry.value)
+		this.account(entry, 1)
+	}
+}
+
+func (this *shard) setAdmissionPolicy(admission AdmissionPolicy) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.admission = admission
+}
+
+// stats adds the counters of the shard to stats.
+func (this *shard) stats(stats *CacheStats) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	stats.Items += len(this.m)
+	stats.TotalItems += this.total
+	stats.Bytes += this.length
+	stats.PayloadBytes += this.payload
+	stats.OverheadBytes += this.length - this.payload
+	stats.Evictions += this.evictions
+	stats.Reclaimed += this.reclaimed
+	stats.Rejections += this.rejections
+	for priority, p := range this.priorities {
+		total := stats.Priorities[priority]
+		total.Items += p.Items
+		total.Bytes += p.Bytes
+		stats.Priorities[priority] = total
+	}
+
+	if this.slabs != nil {
+		stats.Slabs = this.slabs.stats(stats.Slabs)
+	}
+}
+
+// lookup returns the entry stored under key, lazily dropping it if it has
+// already expired.
+func (this *shard) lookup(key string) (entry *Entry, ok bool) {
+	entry, ok = this.m[key]
+	if ok && entry.expired(time.Now().UnixNano()) {
+		this.remove(entry)
+		this.reclaimed++
+		return nil, false
+	}
+
+	return
+}
+
+func (this *shard) insert(entry *Entry) {
+	entry.value = this.own(entry.value)
+	entry.casid = this.cache.next()
+	entry.inserted = entry.casid
+	entry.accessed = time.Now().UnixNano()
+	this.m[entry.key] = entry
+	this.policy.OnInsert(entry)
+	this.account(entry, 1)
+	this.total++
+}
+
+func (this *shard) update(entry *Entry, value []byte, priority uint64) {
+	this.account(entry, -1)
+	previous := entry.value
+	entry.value = this.own(value)
+	this.release(previous)
+	entry.priority = priority
+	entry.accessed = time.Now().UnixNano()
+	this.account(entry, 1)
+	this.policy.OnUpdate(entry)
+}
+
+func (this *shard) recordAccess(key string) {
+	if this.admission != nil {
+		this.admission.Record(key)
+	}
+}
+
+// record hands a change over to the journals of the cache.
+func (this *shard) record(op byte, entry *Entry) {
+	this.cache.record(op, entry)
+}
+
+// admit asks the admission policy whether a new entry may push out the next
+// eviction victim. Entries that fit without evicting are always admitted.
+// The victim is the one of this shard, which is only an estimate of the one
+// the cache is going to evict, as other shards are not locked.
+func (this *shard) admit(key string, size int) bool {
+	if this.admission == nil || atomic.LoadInt64(&this.cache.length)+int64(size) <= int64(this.cache.maxLength) {
+		return true
+	}
+
+	victim := this.policy.Victim()
+	if victim == nil || this.admission.Admit(key, victim.key) {
+		return true
+	}
+
+	this.rejections++
+	return false
+}
+
+func (this *shard) access(entry *Entry) {
+	entry.fetch()
+	this.policy.OnAccess(entry)
+}
+
+func (this *shard) remove(entry *Entry) {
+	this.policy.OnRemove(entry)
+	this.account(entry, -1)
+	delete(this.m, entry.key)
+	this.release(entry.value)
+	entry.value = nil
+}
+
+// own returns the value to store: with slabs it is copied into a chunk, as
+// the caller keeps its slice.
+func (this *shard) own(value []byte) []byte {
+	if this.slabs == nil {
+		return value
+	}
+
+	chunk := this.slabs.alloc(len(value))
+	copy(chunk, value)
+	return chunk
+}
+
+// copy returns a copy of an entry which stays valid once the mutex is
+// released.
+func (this *shard) copy(entry *Entry) (copied Entry) {
+	copied = *entry
+	copied.value = this.out(entry.value)
+	return
+}
+
+// out returns a stored value to a caller: with slabs it is copied, as the
+// chunk is reused as soon as the entry leaves, which may happen before the
+// caller is done with it.
+func (this *shard) out(value []byte) []byte {
+	if this.slabs == nil {
+		return value
+	}
+
+	return append([]byte(nil), value...)
+}
+
+func (this *shard) release(value []byte) {
+	if this.slabs != nil {
+		this.slabs.free(value)
+	}
+}
+
+// account adds (sign 1) or subtracts (sign -1) an entry from the byte and
+// per-priority counters.
+func (this *shard) account(entry *Entry, sign int) {
+	size := footprint(entry.key, entry.value, this.policy)
+	this.length += sign * size
+	this.payload += sign * len(entry.value)
+	atomic.AddInt64(&this.cache.length, int64(sign*size))
+
+	stats, ok := this.priorities[entry.priority]
+	if !ok {
+		stats = new(PriorityStats)
+		this.priorities[entry.priority] = stats
+	}
+
+	stats.Items += sign
+	stats.Bytes += sign * size
+	if stats.Items == 0 {
+		delete(this.priorities, entry.priority)
+	}
+}
+
+// candidate describes the next victim of the shard, so that it can be
+// compared with the victims of the other shards once the mutex is released.
+func (this *shard) candidate() (rank float64, accessed int64, ok bool) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	victim := this.policy.Victim()
+	if victim == nil {
+		return
+	}
+
+	if ranked, isRanked := this.policy.(RankedPolicy); isRanked {
+		rank = ranked.Rank(victim)
+	}
+
+	return rank, victim.accessed, true
+}
+
+// evictOne evicts the next victim of the shard. Evictions are journaled as
+// deletes, or the journals would bring the victims back.
+func (this *shard) evictOne() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if victim := this.policy.Victim(); victim != nil {
+		if evicting, ok := this.policy.(EvictingPolicy); ok {
+			evicting.OnEvict(victim)
+		}
+		this.remove(victim)
+		this.record(journalDelete, victim)
+		this.evictions++
+	}
+}
+
+// sweepSample checks a bounded random sample of entries and reclaims the
+// expired ones, so that the mutex is never held for a full scan.
+func (this *shard) sweepSample() (expired int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	checked := 0
+	for _, entry := range this.m {
+		if checked++; checked > sweepSampleSize {
+			break
+		}
+
+		if entry.expired(now) {
+			this.remove(entry)
+			this.reclaimed++
+			expired++
+		}
+	}
+
+	return
+}
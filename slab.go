@@ -0,0 +1,117 @@
+package whatever
+
+import (
+	"sort"
+)
+
+const (
+	// pages are kept small as every shard grows its own classes
+	slabPageSize     = 64 * 1024
+	slabMinChunkSize = 64
+	slabGrowthFactor = 1.25
+)
+
+// slabAllocator stores values in chunks carved out of large pages, like the
+// slabs of memcached: chunks of every size class are reused once their
+// entry leaves, so that storing a value does not allocate and the garbage
+// collector deals with a few pages instead of millions of small slices.
+// Values larger than a page are allocated as usual. It belongs to a shard
+// and is only used with the shard mutex held.
+type slabAllocator struct {
+	classes []*slabClass
+}
+
+type slabClass struct {
+	size  int
+	pages int
+	used  int
+	free  [][]byte
+}
+
+// SlabStats describes a size class of the slab allocator.
+type SlabStats struct {
+	ChunkSize  int
+	Pages      int
+	Chunks     int
+	UsedChunks int
+}
+
+func newSlabAllocator() *slabAllocator {
+	allocator := new(slabAllocator)
+	for size := slabMinChunkSize; size < slabPageSize; size = int(float64(size) * slabGrowthFactor) {
+		// chunks are aligned to 8 bytes
+		size = (size + 7) &^ 7
+		allocator.classes = append(allocator.classes, &slabClass{size: size})
+	}
+	allocator.classes = append(allocator.classes, &slabClass{size: slabPageSize})
+
+	return allocator
+}
+
+// class returns the smallest class with chunks of at least size bytes, nil
+// if the size needs a regular allocation.
+func (this *slabAllocator) class(size int) *slabClass {
+	i := sort.Search(len(this.classes), func(i int) bool { return this.classes[i].size >= size })
+	if i == len(this.classes) {
+		return nil
+	}
+
+	return this.classes[i]
+}
+
+// alloc returns a slice of size bytes whose capacity is the whole chunk.
+func (this *slabAllocator) alloc(size int) []byte {
+	class := this.class(size)
+	if class == nil {
+		return make([]byte, size)
+	}
+
+	if len(class.free) == 0 {
+		class.grow()
+	}
+
+	chunk := class.free[len(class.free)-1]
+	class.free[len(class.free)-1] = nil
+	class.free = class.free[:len(class.free)-1]
+	class.used++
+
+	return chunk[:size]
+}
+
+// free hands a chunk back to its class. Values which were not allocated in
+// a chunk are left to the garbage collector.
+func (this *slabAllocator) free(value []byte) {
+	class := this.class(cap(value))
+	if class == nil || class.size != cap(value) {
+		return
+	}
+
+	class.free = append(class.free, value[:class.size])
+	class.used--
+}
+
+func (this *slabClass) grow() {
+	page := make([]byte, slabPageSize)
+	for offset := 0; offset+this.size <= slabPageSize; offset += this.size {
+		this.free = append(this.free, page[offset:offset+this.size:offset+this.size])
+	}
+
+	this.pages++
+}
+
+// stats adds the counters of every class to stats, which are indexed by
+// class as all allocators have the same classes.
+func (this *slabAllocator) stats(stats []SlabStats) []SlabStats {
+	if stats == nil {
+		stats = make([]SlabStats, len(this.classes))
+	}
+
+	for i, class := range this.classes {
+		stats[i].ChunkSize = class.size
+		stats[i].Pages += class.pages
+		stats[i].Chunks += class.pages * (slabPageSize / class.size)
+		stats[i].UsedChunks += class.used
+	}
+
+	return stats
+}
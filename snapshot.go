@@ -0,0 +1,321 @@
+package whatever
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot starts with snapshotMagic and a big-endian uint16 version, then
+// every entry follows as a snapshotEntry tag and its fields as varints:
+//
+//	key length, key, value length, value, priority, flags, expires, casid
+//
+// where expires is in nanoseconds since the epoch, 0 meaning never. A
+// snapshotEnd tag closes the file, followed by the casid counter as a
+// big-endian uint64 and the CRC-32 (IEEE) of everything before it.
+const (
+	snapshotMagic   = "WSNP"
+	snapshotVersion = 1
+
+	snapshotEnd   = 0
+	snapshotEntry = 1
+)
+
+var errBadSnapshot = errors.New("Malformed snapshot")
+
+// snapshotReader checksums the bytes consumed from its reader, which unlike
+// a TeeReader leaves out whatever the buffer has read ahead.
+type snapshotReader struct {
+	*bufio.Reader
+	checksum hash.Hash32
+}
+
+func (this *snapshotReader) Read(p []byte) (n int, err error) {
+	n, err = this.Reader.Read(p)
+	this.checksum.Write(p[:n])
+	return
+}
+
+func (this *snapshotReader) ReadByte() (b byte, err error) {
+	if b, err = this.Reader.ReadByte(); err == nil {
+		this.checksum.Write([]byte{b})
+	}
+	return
+}
+
+// Save writes a snapshot of every entry to w, which is the state of the
+// cache at a single point in time.
+func (this *Cache) Save(w io.Writer) error {
+	entries, counter := this.collect()
+	return writeSnapshot(w, entries, counter)
+}
+
+// writeSnapshot encodes entries and the casid counter as a snapshot.
+func writeSnapshot(w io.Writer, entries []Entry, counter uint64) (err error) {
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	writer.WriteString(snapshotMagic)
+	binary.Write(writer, binary.BigEndian, uint16(snapshotVersion))
+
+	for i := range entries {
+		writer.WriteByte(snapshotEntry)
+		if err = writeSnapshotEntry(writer, &entries[i]); err != nil {
+			return
+		}
+	}
+
+	writer.WriteByte(snapshotEnd)
+	binary.Write(writer, binary.BigEndian, counter)
+	if err = writer.Flush(); err != nil {
+		return
+	}
+
+	return binary.Write(w, binary.BigEndian, checksum.Sum32())
+}
+
+// Load reads a snapshot written by Save, storing every entry which has not
+// expired yet with its casid, and continues the casid counter from the one
+// of the snapshot. Nothing is stored unless the whole snapshot is valid.
+func (this *Cache) Load(r io.Reader) (count int, err error) {
+	entries, counter, err := readSnapshot(r)
+	if err != nil {
+		return
+	}
+
+	this.continueCounter(counter)
+
+	now := time.Now().UnixNano()
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			this.shard(entry.key).restore(entry)
+			count++
+		}
+	}
+
+	this.evict()
+	return
+}
+
+// readSnapshot decodes a whole snapshot, returning its entries and casid
+// counter only if it is valid.
+func readSnapshot(r io.Reader) (entries []*Entry, counter uint64, err error) {
+	reader := &snapshotReader{bufio.NewReader(r), crc32.NewIEEE()}
+
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, 0, errBadSnapshot
+	}
+
+	if version := binary.BigEndian.Uint16(header[len(snapshotMagic):]); version != snapshotVersion {
+		return nil, 0, fmt.Errorf("Unsupported snapshot version %d", version)
+	}
+
+	for {
+		var tag byte
+		if tag, err = reader.ReadByte(); err != nil {
+			return
+		}
+
+		if tag == snapshotEnd {
+			break
+		} else if tag != snapshotEntry {
+			return nil, 0, errBadSnapshot
+		}
+
+		var entry *Entry
+		if entry, err = readSnapshotEntry(reader); err != nil {
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = binary.Read(reader, binary.BigEndian, &counter); err != nil {
+		return
+	}
+
+	sum := reader.checksum.Sum32()
+	var expected uint32
+	if err = binary.Read(reader.Reader, binary.BigEndian, &expected); err != nil {
+		return
+	}
+
+	if sum != expected {
+		return nil, 0, errors.New("Snapshot checksum mismatch")
+	}
+
+	return
+}
+
+// continueCounter makes sure the next casid is at least counter.
+func (this *Cache) continueCounter(counter uint64) {
+	for {
+		current := atomic.LoadUint64(&this.counter)
+		if current >= counter || atomic.CompareAndSwapUint64(&this.counter, current, counter) {
+			return
+		}
+	}
+}
+
+// SaveFile writes a snapshot to a temporary file first and renames it over
+// path, so that a crash never leaves a partial snapshot behind.
+func (this *Cache) SaveFile(path string) (err error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(file.Name())
+
+	if err = this.Save(file); err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+// LoadFile loads a snapshot from path.
+func (this *Cache) LoadFile(path string) (count int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	return this.Load(file)
+}
+
+// collect copies every entry and reads the casid counter with every shard
+// mutex held, like clear, so that no change lands halfway through. Encoding
+// the copies is left for after the mutexes are released.
+func (this *Cache) collect() (entries []Entry, counter uint64) {
+	for _, shard := range this.shards {
+		shard.mutex.Lock()
+		defer shard.mutex.Unlock()
+	}
+
+	now := time.Now().UnixNano()
+	for _, shard := range this.shards {
+		for _, entry := range shard.m {
+			if !entry.expired(now) {
+				entries = append(entries, shard.copy(entry))
+			}
+		}
+	}
+
+	return entries, atomic.LoadUint64(&this.counter)
+}
+
+// snapshotWriter and snapshotSource are what entries are encoded to and
+// decoded from, which the write log shares with snapshots.
+type snapshotWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+type snapshotSource interface {
+	io.Reader
+	io.ByteReader
+}
+
+func writeUvarint(writer snapshotWriter, value uint64) (err error) {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	_, err = writer.Write(buffer[:binary.PutUvarint(buffer, value)])
+	return
+}
+
+func writeVarint(writer snapshotWriter, value int64) (err error) {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	_, err = writer.Write(buffer[:binary.PutVarint(buffer, value)])
+	return
+}
+
+func writeSnapshotEntry(writer snapshotWriter, entry *Entry) error {
+	writeUvarint(writer, uint64(len(entry.key)))
+	writer.WriteString(entry.key)
+	writeUvarint(writer, uint64(len(entry.value)))
+	writer.Write(entry.value)
+	writeUvarint(writer, entry.priority)
+	writeUvarint(writer, entry.flags)
+	writeVarint(writer, entry.expires)
+	return writeUvarint(writer, entry.casid)
+}
+
+func readSnapshotEntry(reader snapshotSource) (entry *Entry, err error) {
+	entry = new(Entry)
+
+	key, err := readSnapshotBytes(reader)
+	if err != nil {
+		return
+	}
+	entry.key = string(key)
+
+	if entry.value, err = readSnapshotBytes(reader); err != nil {
+		return
+	}
+
+	if entry.priority, err = binary.ReadUvarint(reader); err != nil {
+		return
+	}
+
+	if entry.flags, err = binary.ReadUvarint(reader); err != nil {
+		return
+	}
+
+	if entry.expires, err = binary.ReadVarint(reader); err != nil {
+		return
+	}
+
+	entry.casid, err = binary.ReadUvarint(reader)
+	return
+}
+
+func readSnapshotBytes(reader snapshotSource) (data []byte, err error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return
+	}
+
+	// not preallocated, so that a corrupted length fails at the end of file
+	// instead of allocating gigabytes
+	if data, err = ioutil.ReadAll(io.LimitReader(reader, int64(length))); err == nil && uint64(len(data)) != length {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// restore stores an entry read from a snapshot, keeping its casid.
+func (this *shard) restore(entry *Entry) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if stored, found := this.m[entry.key]; found {
+		this.remove(stored)
+	}
+
+	casid := entry.casid
+	this.insert(entry)
+	entry.casid = casid
+}
@@ -1,9 +1,21 @@
 package whatever
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -32,6 +44,36 @@ func setup() {
 	rand.Seed(time.Now().UTC().UnixNano())
 }
 
+// startServer runs an in-process server on a free loopback port.
+func startServer(t *testing.T) string {
+	return startConfiguredServer(t, func(server *Server) {})
+}
+
+// startConfiguredServer starts a server after letting configure set it up.
+func startConfiguredServer(t *testing.T, configure func(server *Server)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server := NewServer(addr, false, 1024*1024)
+	configure(server)
+	go server.Start()
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Cannot start server at " + addr)
+	return ""
+}
+
 func TestWhatever(t *testing.T) {
 	setup()
 
@@ -189,3 +231,1548 @@ func BenchmarkCircleAccess(b *testing.B) {
 		}
 	}
 }
+
+func TestCacheExpiry(t *testing.T) {
+	cache := NewCache(1024)
+	defer cache.Close()
+
+	cache.Set("relative", []byte("bar"), 0, 0, 1)
+	cache.Set("absolute", []byte("bar"), 0, 0, uint64(time.Now().Unix()-10))
+	cache.Set("forever", []byte("bar"), 0, 0, 0)
+
+	if _, _, _, ok := cache.Get("relative"); !ok {
+		t.Error("«Get» expected to return entry before its exptime")
+	}
+
+	if _, _, _, ok := cache.Get("absolute"); ok {
+		t.Error("«Get» expected to miss entry with exptime in the past")
+	}
+
+	if _, ok := cache.Add("absolute", []byte("bar"), 0, 0, 0); !ok {
+		t.Error("«Add» expected to succeed over an expired entry")
+	}
+
+	// like in memcached, appending and prepending keep the expiry
+	cache.Append("relative", []byte("baz"), 0, 0, 0)
+	cache.Prepend("relative", []byte("foo"), 0, 0, 0)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, _, _, _, ok := cache.Gets("relative"); ok {
+		t.Error("«Gets» expected to miss expired entry, appended to or not")
+	}
+
+	cache.Set("sweep", []byte("bar"), 0, 0, uint64(time.Now().Unix()-10))
+	cache.shard("sweep").sweepSample()
+
+	length := cache.Stats().PayloadBytes
+
+	if length != 2*len("bar") {
+		t.Error(fmt.Sprintf("Sweeper expected to reclaim expired bytes: expected length %d, got %d", 2*len("bar"), length))
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	c := NewClient()
+	c.AddServer(startServer(t))
+	c.AddServer(startServer(t))
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("missing")}
+	for _, key := range keys[:3] {
+		if err := c.Set(key, 0, 1, 0, append([]byte("value-"), key...)); err != nil {
+			t.Error("«Set» command failed")
+			t.Error(err)
+			return
+		}
+	}
+
+	items, err := c.GetMulti(keys)
+	if err != nil {
+		t.Error("«GetMulti» command failed")
+		t.Error(err)
+		return
+	}
+
+	if len(items) != 3 {
+		t.Error(fmt.Sprintf("«GetMulti» command returned %d items, expected 3", len(items)))
+	}
+
+	for _, key := range keys[:3] {
+		item, ok := items[string(key)]
+		if !ok || !bytes.Equal(item.Value, append([]byte("value-"), key...)) || item.Flags != 1 {
+			t.Error(fmt.Sprintf("«GetMulti» command returned wrong item for key %s", key))
+		}
+	}
+
+	if value, _, err := c.Get([]byte("b")); err != nil || !bytes.Equal(value, []byte("value-b")) {
+		t.Error("«Get» command expected to work on a connection reused after «GetMulti»")
+	}
+
+	// far more keys than a single line can hold
+	var many [][]byte
+	for n := 0; n < 2000; n++ {
+		many = append(many, []byte(fmt.Sprintf("many-%d", n)))
+	}
+
+	for _, key := range many[:10] {
+		c.Set(key, 0, 0, 0, key)
+	}
+
+	if items, err := c.GetMulti(many); err != nil || len(items) != 10 {
+		t.Error(fmt.Sprintf("«GetMulti» command expected to split long key lists, got %d items and error %v", len(items), err))
+	}
+
+	if value, _, err := c.Get([]byte("b")); err != nil || !bytes.Equal(value, []byte("value-b")) {
+		t.Error("«Get» command expected to work after «GetMulti» of many keys")
+	}
+}
+
+func TestConcurrentConnections(t *testing.T) {
+	addr := startServer(t)
+
+	const connCount, iterCount = 200, 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, connCount)
+	for n := 0; n < connCount; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+			for i := 0; i < iterCount; i++ {
+				key := fmt.Sprintf("conn%d-%d", n, i)
+				value := fmt.Sprintf("value-%d-%d", n, i)
+
+				fmt.Fprintf(rw, "set %s 0 0 0 %d \r\n%s\r\n", key, len(value), value)
+				fmt.Fprintf(rw, "get %s shared\r\n", key)
+				fmt.Fprintf(rw, "set shared 0 0 0 %d \r\n%s\r\n", len(value), value)
+				if err = rw.Flush(); err != nil {
+					errs <- err
+					return
+				}
+
+				expected := fmt.Sprintf("%sVALUE %s 0 %d \r\n%s\r\n", msgStored, key, len(value), value)
+				response := make([]byte, len(expected))
+				if _, err = io.ReadFull(rw, response); err != nil {
+					errs <- err
+					return
+				}
+				if string(response) != expected {
+					errs <- fmt.Errorf("Unexpected response %q, expected %q", response, expected)
+					return
+				}
+
+				// the shared key is overwritten by other connections, skip it
+				for {
+					line, err := rw.ReadString('\n')
+					if err != nil {
+						errs <- err
+						return
+					}
+					if line == msgStored {
+						break
+					}
+				}
+			}
+		}(n)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestIncrDecr(t *testing.T) {
+	c := NewClient()
+	c.AddServer(startServer(t))
+
+	key := []byte("counter")
+	if _, err := c.Incr(key, 1); err == nil {
+		t.Error("«Incr» command expected to fail on a missing key")
+	}
+
+	c.Set(key, 5, 0, 0, []byte("18446744073709551614"))
+	if value, err := c.Incr(key, 3); err != nil || value != 1 {
+		t.Error(fmt.Sprintf("«Incr» command expected to wrap around to 1, got %d (%v)", value, err))
+	}
+
+	if value, err := c.Decr(key, 10); err != nil || value != 0 {
+		t.Error(fmt.Sprintf("«Decr» command expected to floor at 0, got %d (%v)", value, err))
+	}
+
+	_, _, casid, _ := c.Gets(key)
+	if value, err := c.Incr(key, 42); err != nil || value != 42 {
+		t.Error(fmt.Sprintf("«Incr» command expected to return 42, got %d (%v)", value, err))
+	}
+	if _, _, newCasid, _ := c.Gets(key); newCasid == casid {
+		t.Error("«Incr» command expected to bump casid")
+	}
+
+	c.Set(key, 0, 0, 0, []byte("bar"))
+	if _, err := c.Incr(key, 1); err == nil {
+		t.Error("«Incr» command expected to fail on a non-numeric value")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c := NewClient()
+	c.AddServer(startServer(t))
+
+	key := []byte("session")
+	if err := c.Touch(key, 1); err == nil {
+		t.Error("«Touch» command expected to fail on a missing key")
+	}
+
+	c.Set(key, 0, 0, 1, []byte("bar"))
+	if err := c.Touch(key, 0); err != nil {
+		t.Error("«Touch» command failed")
+		t.Error(err)
+	}
+
+	c.Set([]byte("gat"), 0, 0, 1, []byte("baz"))
+	if value, _, err := c.GetAndTouch([]byte("gat"), 0); err != nil || !bytes.Equal(value, []byte("baz")) {
+		t.Error(fmt.Sprintf("«GetAndTouch» command returned %s (%v), expected baz", value, err))
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if value, _, _ := c.Get(key); !bytes.Equal(value, []byte("bar")) {
+		t.Error("«Touch» command expected to remove the expiry")
+	}
+
+	if value, _, _ := c.Get([]byte("gat")); !bytes.Equal(value, []byte("baz")) {
+		t.Error("«GetAndTouch» command expected to remove the expiry")
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	c := NewClient()
+	c.AddServer(startServer(t))
+	c.AddServer(startServer(t))
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	for _, key := range keys {
+		c.Set(key, 0, 0, 0, []byte("bar"))
+	}
+
+	if err := c.FlushAll(1); err != nil {
+		t.Error("«FlushAll» command failed")
+		t.Error(err)
+	}
+
+	if items, _ := c.GetMulti(keys); len(items) != len(keys) {
+		t.Error("«FlushAll» command with delay expected to keep entries until it fires")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if items, _ := c.GetMulti(keys); len(items) != 0 {
+		t.Error(fmt.Sprintf("«FlushAll» command expected to invalidate every entry, %d left", len(items)))
+	}
+
+	c.Set(keys[0], 0, 0, 0, []byte("bar"))
+	if err := c.FlushAll(0); err != nil {
+		t.Error("«FlushAll» command failed")
+	}
+
+	if value, _, _ := c.Get(keys[0]); value != nil {
+		t.Error("«FlushAll» command expected to invalidate entries immediately")
+	}
+}
+
+func TestStats(t *testing.T) {
+	addr := startServer(t)
+	c := NewClient()
+	c.AddServer(addr)
+
+	c.Set([]byte("low"), 0, 0, 0, []byte("bar"))
+	c.Set([]byte("high"), 10, 0, 0, []byte("bazz"))
+	c.Get([]byte("low"))
+	c.Get([]byte("missing"))
+
+	stats, err := c.Stats()
+	if err != nil {
+		t.Error("«Stats» command failed")
+		t.Error(err)
+		return
+	}
+
+	expected := map[string]string{
+		"cmd_get":          "2",
+		"cmd_set":          "2",
+		"get_hits":         "1",
+		"get_misses":       "1",
+		"curr_items":       "2",
+		"bytes":            strconv.Itoa(footprint("low", make([]byte, 3), NewPriorityPolicy()) + footprint("high", make([]byte, 4), NewPriorityPolicy())),
+		"bytes_payload":    "7",
+		"limit_maxbytes":   "1048576",
+		"curr_connections": "1",
+	}
+	for name, value := range expected {
+		if stats[addr][name] != value {
+			t.Error(fmt.Sprintf("«Stats» command returned %s=%s, expected %s", name, stats[addr][name], value))
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "stats priorities\r\n")
+	priorities := fmt.Sprintf("STAT priority:0:items 1\r\nSTAT priority:0:bytes %d\r\nSTAT priority:10:items 1\r\nSTAT priority:10:bytes %d\r\nEND\r\n",
+		footprint("low", make([]byte, 3), NewPriorityPolicy()), footprint("high", make([]byte, 4), NewPriorityPolicy()))
+	response := make([]byte, len(priorities))
+	io.ReadFull(conn, response)
+
+	if string(response) != priorities {
+		t.Error(fmt.Sprintf("«stats priorities» command returned %q, expected %q", response, priorities))
+	}
+}
+
+func TestNoreply(t *testing.T) {
+	c := NewClient()
+	c.AddServer(startServer(t))
+
+	for i := 0; i < 100; i++ {
+		if err := c.SetQuiet([]byte(fmt.Sprintf("quiet%d", i)), 0, 0, 0, []byte("bar")); err != nil {
+			t.Error("«SetQuiet» command failed")
+			t.Error(err)
+			return
+		}
+	}
+
+	if err := c.DeleteQuiet([]byte("quiet0")); err != nil {
+		t.Error("«DeleteQuiet» command failed")
+	}
+
+	// a regular command on the same connection must see its own reply only
+	if value, _, err := c.Get([]byte("quiet99")); err != nil || !bytes.Equal(value, []byte("bar")) {
+		t.Error(fmt.Sprintf("«Get» command returned %s (%v) after quiet writes, expected bar", value, err))
+	}
+
+	if value, _, _ := c.Get([]byte("quiet0")); value != nil {
+		t.Error("«DeleteQuiet» command expected to delete the key")
+	}
+}
+
+func binaryRequestPacket(opcode uint8, vbucket uint16, cas uint64, extras []byte, key []byte, value []byte) []byte {
+	packet := make([]byte, binaryHeaderLength, binaryHeaderLength+len(extras)+len(key)+len(value))
+	packet[0] = binaryMagicRequest
+	packet[1] = opcode
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(key)))
+	packet[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(packet[6:], vbucket)
+	binary.BigEndian.PutUint32(packet[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint64(packet[16:], cas)
+
+	packet = append(packet, extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+func readBinaryResponsePacket(r io.Reader) (opcode uint8, status uint16, cas uint64, extras []byte, key []byte, value []byte, err error) {
+	header := make([]byte, binaryHeaderLength)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+
+	keyLength, extrasLength := int(binary.BigEndian.Uint16(header[2:])), int(header[4])
+	return header[1], binary.BigEndian.Uint16(header[6:]), binary.BigEndian.Uint64(header[16:]),
+		body[:extrasLength], body[extrasLength : extrasLength+keyLength], body[extrasLength+keyLength:], nil
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	addr := startServer(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	extras := make([]byte, 12)
+	binary.BigEndian.PutUint32(extras, 42)
+	binary.BigEndian.PutUint32(extras[8:], 7)
+	conn.Write(binaryRequestPacket(opSet, 0, 0, extras, []byte("foo"), []byte("bar")))
+	_, status, cas, _, _, _, err := readBinaryResponsePacket(conn)
+	if err != nil || status != statusOk || cas == 0 {
+		t.Error(fmt.Sprintf("Binary «set» command failed with status 0x%x (%v)", status, err))
+	}
+
+	// quiet misses are skipped, so only the GETK hit and the NOOP reply
+	conn.Write(append(append(binaryRequestPacket(opGetQ, 0, 0, nil, []byte("missing"), nil),
+		binaryRequestPacket(opGetK, 0, 0, nil, []byte("foo"), nil)...),
+		binaryRequestPacket(opNoop, 0, 0, nil, nil, nil)...))
+
+	opcode, status, getCas, flags, key, value, err := readBinaryResponsePacket(conn)
+	if err != nil || opcode != opGetK || status != statusOk || !bytes.Equal(key, []byte("foo")) || !bytes.Equal(value, []byte("bar")) || binary.BigEndian.Uint32(flags) != 42 {
+		t.Error(fmt.Sprintf("Binary «getk» command returned opcode=0x%x status=0x%x key=%s value=%s (%v)", opcode, status, key, value, err))
+	}
+
+	if getCas != cas {
+		t.Error(fmt.Sprintf("Binary «getk» command returned casid %d, «set» reported %d", getCas, cas))
+	}
+
+	if opcode, _, _, _, _, _, _ := readBinaryResponsePacket(conn); opcode != opNoop {
+		t.Error(fmt.Sprintf("Binary «noop» expected after quiet miss, got opcode 0x%x", opcode))
+	}
+
+	arithmetic := make([]byte, 20)
+	binary.BigEndian.PutUint64(arithmetic, 5)
+	binary.BigEndian.PutUint64(arithmetic[8:], 10)
+	conn.Write(binaryRequestPacket(opIncr, 0, 0, arithmetic, []byte("counter"), nil))
+	conn.Write(binaryRequestPacket(opIncr, 0, 0, arithmetic, []byte("counter"), nil))
+	for _, expected := range []uint64{10, 15} {
+		_, status, _, _, _, value, _ := readBinaryResponsePacket(conn)
+		if status != statusOk || len(value) != 8 || binary.BigEndian.Uint64(value) != expected {
+			t.Error(fmt.Sprintf("Binary «incr» command returned status=0x%x value=%v, expected %d", status, value, expected))
+		}
+	}
+
+	c := NewClient()
+	c.AddServer(addr)
+	if stats, _ := c.Stats(); stats[addr]["cmd_set"] != "1" {
+		t.Error("Binary «set» command expected to be counted in stats")
+	}
+
+	// reporting the casid of a write does not make it a read
+	text, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer text.Close()
+
+	fmt.Fprintf(text, "mg counter h\r\n")
+	if line, _ := bufio.NewReader(text).ReadString('\n'); line != "HD h0\r\n" {
+		t.Error(fmt.Sprintf("Binary «incr» command expected to leave the entry unfetched, got %q", line))
+	}
+
+	conn.Write(binaryRequestPacket(opDelete, 0, 0, nil, []byte("foo"), nil))
+	if _, status, _, _, _, _, _ := readBinaryResponsePacket(conn); status != statusOk {
+		t.Error(fmt.Sprintf("Binary «delete» command failed with status 0x%x", status))
+	}
+
+	conn.Write(binaryRequestPacket(opGet, 0, 0, nil, []byte("foo"), nil))
+	if _, status, _, _, _, _, _ := readBinaryResponsePacket(conn); status != statusNotFound {
+		t.Error(fmt.Sprintf("Binary «get» command expected to miss, got status 0x%x", status))
+	}
+
+	conn.Write(binaryRequestPacket(opSet, 0, 0, extras, []byte("big"), make([]byte, maxValueLength+1)))
+	if _, status, _, _, _, _, _ := readBinaryResponsePacket(conn); status != statusTooLarge {
+		t.Error(fmt.Sprintf("Binary «set» command expected to reject a large value, got status 0x%x", status))
+	}
+
+	conn.Write(binaryRequestPacket(opGet, 0, 0, nil, []byte("f\no"), nil))
+	if _, status, _, _, _, _, _ := readBinaryResponsePacket(conn); status != statusInvalidArgs {
+		t.Error(fmt.Sprintf("Binary «get» command expected to reject an invalid key, got status 0x%x", status))
+	}
+}
+
+func TestMetaProtocol(t *testing.T) {
+	conn, err := net.Dial("tcp", startServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	exchange := []struct {
+		request  string
+		response string
+	}{
+		{"ms foo 3 P7 F5 T0 k\r\nbar\r\n", "HD kfoo\r\n"},
+		{"mg foo s v f p t h Oabc\r\n", "VA 3 s3 f5 p7 t-1 h0 Oabc\r\nbar\r\n"},
+		{"mg foo h\r\n", "HD h1\r\n"},
+		{"mg missing v q\r\nmn\r\n", "MN\r\n"},
+		{"mg missing v\r\n", "EN\r\n"},
+		{"ms foo 3 ME\r\nbaz\r\n", "NS\r\n"},
+		{"ms foo 3 C999\r\nbaz\r\n", "EX\r\n"},
+		{"ms foo 3 MA c\r\nqux\r\n", "HD c2\r\n"},
+		{"ma counter\r\n", "NF\r\n"},
+		{"ma counter N0 J10 v\r\n", "VA 2\r\n10\r\n"},
+		{"ma counter D5 MD v\r\n", "VA 1\r\n5\r\n"},
+		{"ma counter T60 t v\r\n", "VA 1 t60\r\n6\r\n"},
+		{"md counter q\r\nmd counter\r\n", "NF\r\n"},
+		{"mg foo x\r\n", "CLIENT_ERROR Invalid flag\r\n"},
+	}
+
+	for _, e := range exchange {
+		if _, err := conn.Write([]byte(e.request)); err != nil {
+			t.Fatal(err)
+		}
+
+		response := make([]byte, len(e.response))
+		if _, err := io.ReadFull(r, response); err != nil || string(response) != e.response {
+			t.Error(fmt.Sprintf("Meta command %q returned %q, expected %q", e.request, response, e.response))
+		}
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	conn, err := net.Dial("tcp", startServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	exchange := []struct {
+		request  string
+		response string
+	}{
+		{"set foo 0 0 0 3\r\nbar\r\n", "STORED\r\n"},
+		{"getx foo\r\n", "ERROR\r\n"},
+		{"settings foo 0 0 0 3\r\n", "ERROR\r\n"},
+		{" get foo\r\n", "ERROR\r\n"},
+		{"\r\n", "ERROR\r\n"},
+		{"get\r\n", "CLIENT_ERROR Wrong number of arguments\r\n"},
+		{"set foo 0 0 0\r\n", "CLIENT_ERROR Wrong number of arguments\r\n"},
+		{"incr foo 1 2\r\n", "CLIENT_ERROR Wrong number of arguments\r\n"},
+		{"get foo\r\n", "VALUE foo 0 3 \r\nbar\r\nEND\r\n"},
+		{"get missing  foo\r\n", "VALUE foo 0 3 \r\nbar\r\nEND\r\n"},
+		{"set  baz 0 0  0 3\r\nqux\r\n", "STORED\r\n"},
+		{"set baz 0 0 0\t3\r\nqux\r\n", "CLIENT_ERROR Wrong number of arguments\r\nERROR\r\n"},
+		{"gets foo\r\n", "VALUE foo 0 3 1 \r\nbar\r\nEND\r\n"},
+	}
+
+	for _, e := range exchange {
+		if _, err := conn.Write([]byte(e.request)); err != nil {
+			t.Fatal(err)
+		}
+
+		response := make([]byte, len(e.response))
+		if _, err := io.ReadFull(r, response); err != nil || string(response) != e.response {
+			t.Error(fmt.Sprintf("Command %q returned %q, expected %q", e.request, response, e.response))
+		}
+	}
+
+	// the exported parser methods take whole lines
+	parser := &Parser{cmd: []byte("delete  foo noreply")}
+	if key, noreply, ok := parser.ParseDeleteCmd(); !ok || string(key) != "foo" || !noreply {
+		t.Error(fmt.Sprintf("«ParseDeleteCmd» returned %q, %t, %t", key, noreply, ok))
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	// every value is 1 byte long and the cache holds 3 entries
+	expected := map[string][]string{
+		"priority": {"high", "c", "d"},
+		"lru":      {"a", "c", "d"},
+		"lfu":      {"high", "a", "c"},
+		"fifo":     {"b", "c", "d"},
+	}
+
+	for name, survivors := range expected {
+		newPolicy, err := EvictionPolicyFactory(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the victims of the shards are compared, so the order holds across shards
+		cache := NewCache(footprint("high", []byte("h"), newPolicy()) + 2*footprint("a", []byte("a"), newPolicy()))
+		cache.SetEvictionPolicy(newPolicy)
+
+		cache.Set("high", []byte("h"), 10, 0, 0)
+		cache.Set("a", []byte("a"), 0, 0, 0)
+		cache.Set("b", []byte("b"), 0, 0, 0)
+		cache.Get("high")
+		cache.Get("a")
+		cache.Get("a")
+		cache.Set("c", []byte("c"), 0, 0, 0)
+		cache.Get("c")
+		cache.Set("d", []byte("d"), 5, 0, 0)
+		cache.Get("d")
+		cache.Close()
+
+		for _, key := range survivors {
+			if _, _, _, ok := cache.Get(key); !ok {
+				t.Error(fmt.Sprintf("«%s» eviction policy expected to keep key %s", name, key))
+			}
+		}
+	}
+
+	if _, err := EvictionPolicyFactory("random"); err == nil {
+		t.Error("Unknown eviction policy expected to be rejected")
+	}
+
+	// entries are charged for the handle of the policy tracking them
+	cache := NewCache(1024 * 1024)
+	defer cache.Close()
+
+	value := []byte("a")
+	cache.Set("a", value, 0, 0, 0)
+	cache.SetEvictionPolicy(func() EvictionPolicy { return NewLFUPolicy() })
+
+	if length := cache.Stats().Bytes; length != footprint("a", value, NewLFUPolicy()) {
+		t.Error(fmt.Sprintf("«lfu» eviction policy expected to charge %d bytes, got %d", footprint("a", value, NewLFUPolicy()), length))
+	}
+}
+
+func TestGreedyDualSize(t *testing.T) {
+	cache := NewShardedCache(footprint("large", make([]byte, 600), NewGreedyDualSizePolicy())+footprint("small", make([]byte, 100), NewGreedyDualSizePolicy())+footprint("medium", make([]byte, 300), NewGreedyDualSizePolicy()), 1)
+	defer cache.Close()
+	cache.SetEvictionPolicy(func() EvictionPolicy { return NewGreedyDualSizePolicy() })
+
+	// the large cheap value has the lowest cost per byte
+	cache.Set("large", make([]byte, 600), 60, 0, 0)
+	cache.Set("small", make([]byte, 100), 50, 0, 0)
+	cache.Set("medium", make([]byte, 300), 90, 0, 0)
+	cache.Set("new", make([]byte, 100), 20, 0, 0)
+
+	if _, _, _, ok := cache.Get("large"); ok {
+		t.Error("GreedyDual-Size expected to evict the large cheap entry first")
+	}
+
+	for _, key := range []string{"small", "medium", "new"} {
+		if _, _, _, ok := cache.Get(key); !ok {
+			t.Error(fmt.Sprintf("GreedyDual-Size expected to keep key %s", key))
+		}
+	}
+
+	// after inflation even an expensive entry ages out if it is never used
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("hot%d", i)
+		cache.Set(key, make([]byte, 100), 20, 0, 0)
+		cache.Get(key)
+		cache.Get("small")
+		cache.Get("new")
+	}
+
+	if _, _, _, ok := cache.Get("medium"); ok {
+		t.Error("GreedyDual-Size expected to age out an unused entry")
+	}
+
+	// only evictions inflate L, deleting the cheapest entry does not
+	policy := cache.shards[0].policy.(*GreedyDualSizePolicy)
+	inflation := policy.inflation
+	cache.Delete(policy.Victim().key)
+	if inflation == 0 || policy.inflation != inflation {
+		t.Error(fmt.Sprintf("GreedyDual-Size expected to inflate L on eviction only, L went from %f to %f", inflation, policy.inflation))
+	}
+
+	// a shard which never evicted competes on equal terms with one which did
+	value := make([]byte, 100)
+	sharded := NewShardedCache(3*footprint("k00", value, NewGreedyDualSizePolicy()), 2)
+	defer sharded.Close()
+	sharded.SetEvictionPolicy(func() EvictionPolicy { return NewGreedyDualSizePolicy() })
+
+	var evicting, quiet []string
+	for i := 0; len(evicting) < 6 || len(quiet) < 1; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if sharded.shard(key) == sharded.shards[0] {
+			evicting = append(evicting, key)
+		} else {
+			quiet = append(quiet, key)
+		}
+	}
+
+	sharded.Set(quiet[0], value, 90, 0, 0)
+	for _, key := range evicting[:6] {
+		sharded.Set(key, value, 50, 0, 0)
+	}
+
+	if _, _, _, ok := sharded.Get(quiet[0]); !ok {
+		t.Error("GreedyDual-Size expected to compare credits above L across shards")
+	}
+}
+
+func TestTinyLFUAdmission(t *testing.T) {
+	// admission compares with the victim of the same shard
+	value := make([]byte, 1)
+	cache := NewShardedCache(4*footprint("a", value, NewLRUPolicy()), 1)
+	defer cache.Close()
+	cache.SetEvictionPolicy(func() EvictionPolicy { return NewLRUPolicy() })
+	cache.SetAdmissionPolicy(func() AdmissionPolicy { return NewTinyLFU(64) })
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cache.Set(key, value, 0, 0, 0)
+		for i := 0; i < 3; i++ {
+			cache.Get(key)
+		}
+	}
+
+	// one-hit wonders must not push out the hot set
+	for i := 0; i < 100; i++ {
+		if _, ok := cache.Set(fmt.Sprintf("once%d", i), value, 0, 0, 0); ok {
+			t.Error(fmt.Sprintf("TinyLFU expected to reject one-hit wonder once%d", i))
+			break
+		}
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, _, _, ok := cache.Get(key); !ok {
+			t.Error(fmt.Sprintf("TinyLFU expected to keep hot key %s", key))
+		}
+	}
+
+	// a key that keeps being requested eventually gets in
+	for i := 0; i < 10; i++ {
+		cache.Get("rising")
+	}
+	if _, ok := cache.Set("rising", value, 0, 0, 0); !ok {
+		t.Error("TinyLFU expected to admit a frequently requested key")
+	}
+
+	if stats := cache.Stats(); stats.Rejections != 100 {
+		t.Error(fmt.Sprintf("TinyLFU expected to count 100 rejections, got %d", stats.Rejections))
+	}
+}
+
+func BenchmarkCacheInsert(b *testing.B) {
+	for _, itemCount := range []int{1024, 16 * 1024, 128 * 1024} {
+		b.Run(fmt.Sprintf("items=%d", itemCount), func(b *testing.B) {
+			value := make([]byte, valueLength)
+			cache := NewCache(itemCount * footprint(strconv.Itoa(itemCount), value, NewPriorityPolicy()))
+			defer cache.Close()
+
+			for i := 0; i < itemCount; i++ {
+				cache.Set(strconv.Itoa(i), value, uint64(i%16), 0, 0)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.Set(strconv.Itoa(itemCount+i), value, uint64(i%16), 0, 0)
+			}
+		})
+	}
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	// run with -cpu 1,2,4,8 to see the throughput scale with GOMAXPROCS
+	for _, shards := range []int{1, DefaultShardCount} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			const itemCount = 16 * 1024
+			value := make([]byte, valueLength)
+			cache := NewShardedCache(itemCount*footprint(strconv.Itoa(itemCount), value, NewPriorityPolicy()), shards)
+			defer cache.Close()
+
+			keys := make([]string, itemCount)
+			for i := range keys {
+				keys[i] = strconv.Itoa(i)
+				cache.Set(keys[i], value, uint64(i%16), 0, 0)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					key := keys[r.Intn(itemCount)]
+					if r.Intn(10) == 0 {
+						cache.Set(key, value, uint64(r.Intn(16)), 0, 0)
+					} else {
+						cache.Get(key)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestSlabs(t *testing.T) {
+	cache := NewCache(1024 * 1024)
+	defer cache.Close()
+
+	cache.Set("before", []byte("stored before slabs"), 0, 0, 0)
+	cache.EnableSlabs()
+
+	cache.Set("foo", []byte("bar"), 0, 0, 0)
+	cache.Append("foo", []byte("baz"), 0, 0, 0)
+	value, _, _, ok := cache.Get("foo")
+	if !ok || string(value) != "barbaz" {
+		t.Error(fmt.Sprintf("«Get» with slabs returned %q, expected %q", value, "barbaz"))
+	}
+
+	// a value read before its entry leaves is not overwritten by the next one
+	cache.Delete("foo")
+	cache.Set("foo", []byte("qux123"), 0, 0, 0)
+	if string(value) != "barbaz" {
+		t.Error(fmt.Sprintf("Value read with slabs changed to %q after its chunk was reused", value))
+	}
+
+	if value, _, _, ok := cache.Get("before"); !ok || string(value) != "stored before slabs" {
+		t.Error(fmt.Sprintf("«Get» returned %q for a value moved into slabs", value))
+	}
+
+	cache.Set("large", make([]byte, 2*slabPageSize), 0, 0, 0)
+
+	stats := cache.Stats()
+	used := 0
+	for _, class := range stats.Slabs {
+		used += class.UsedChunks
+	}
+	if used != 2 {
+		t.Error(fmt.Sprintf("Slabs expected to have 2 used chunks, got %d", used))
+	}
+
+	if class := stats.Slabs[0]; class.ChunkSize != slabMinChunkSize || class.Pages == 0 || class.Chunks != class.Pages*slabPageSize/slabMinChunkSize {
+		t.Error(fmt.Sprintf("Unexpected stats of the smallest slab class: %+v", class))
+	}
+}
+
+func BenchmarkSlabGC(b *testing.B) {
+	// compares the GC pauses of a churning cache with and without slabs
+	for _, slabs := range []bool{false, true} {
+		b.Run(fmt.Sprintf("slabs=%t", slabs), func(b *testing.B) {
+			const itemCount = 256 * 1024
+			value := make([]byte, valueLength)
+			cache := NewCache(itemCount * footprint(strconv.Itoa(itemCount), value, NewPriorityPolicy()))
+			defer cache.Close()
+			if slabs {
+				cache.EnableSlabs()
+			}
+
+			for i := 0; i < itemCount; i++ {
+				cache.Set(strconv.Itoa(i), append([]byte(nil), value...), 0, 0, 0)
+			}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cache.Set(strconv.Itoa(i%itemCount), append([]byte(nil), value...), 0, 0, 0)
+			}
+			b.StopTimer()
+
+			runtime.ReadMemStats(&after)
+			if collections := after.NumGC - before.NumGC; collections > 0 {
+				b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(collections), "pause-ns/gc")
+				b.ReportMetric(float64(collections), "gcs")
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	cache := NewCache(1024 * 1024)
+	defer cache.Close()
+
+	cache.Set("foo", []byte("bar"), 7, 42, 0)
+	cache.Set("expiring", []byte("soon"), 0, 0, 3600)
+	cache.Set("expired", []byte("gone"), 0, 0, uint64(time.Now().Unix()-10))
+	_, _, _, casid, _ := cache.Gets("foo")
+
+	var snapshot bytes.Buffer
+	if err := cache.Save(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewCache(1024 * 1024)
+	defer restored.Close()
+
+	if count, err := restored.Load(bytes.NewReader(snapshot.Bytes())); err != nil || count != 2 {
+		t.Fatal(fmt.Sprintf("Snapshot expected to load 2 entries, got %d: %v", count, err))
+	}
+
+	if entry, ok := restored.Peek("foo"); !ok || string(entry.value) != "bar" || entry.priority != 7 || entry.flags != 42 || entry.casid != casid {
+		t.Error(fmt.Sprintf("Snapshot restored unexpected entry %+v", entry))
+	}
+
+	original, _ := cache.Peek("expiring")
+	if entry, ok := restored.Peek("expiring"); !ok || entry.expires != original.expires {
+		t.Error("Snapshot expected to keep the expiry of entries")
+	}
+
+	if _, ok := restored.Peek("expired"); ok {
+		t.Error("Snapshot expected to skip expired entries")
+	}
+
+	restored.Set("new", []byte("value"), 0, 0, 0)
+	if _, _, _, newCasid, _ := restored.Gets("new"); newCasid <= casid {
+		t.Error(fmt.Sprintf("Snapshot expected to continue the casid counter, got casid %d after %d", newCasid, casid))
+	}
+
+	corrupted := append([]byte(nil), snapshot.Bytes()...)
+	corrupted[len(snapshotMagic)+4] ^= 0xff
+	if _, err := restored.Load(bytes.NewReader(corrupted)); err == nil {
+		t.Error("Snapshot with a bad checksum expected to be rejected")
+	}
+
+	// a snapshot is a single point in time: first is always written before
+	// second, though its shard is saved before the one of second
+	first, second := "", ""
+	for i := 0; second == ""; i++ {
+		key := fmt.Sprintf("point%d", i)
+		if cache.shard(key) == cache.shards[0] {
+			first = key
+		} else if first != "" {
+			second = key
+		}
+	}
+
+	// fillers keep the shards in between busy for a while
+	for i := 0; i < 3000; i++ {
+		cache.Set(fmt.Sprintf("filler%d", i), nil, 0, 0, 0)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			value := []byte(strconv.Itoa(i))
+			cache.Set(first, value, 0, 0, 0)
+			cache.Set(second, value, 0, 0, 0)
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		var snapshot bytes.Buffer
+		cache.Save(&snapshot)
+		entries, _, _ := readSnapshot(&snapshot)
+
+		values := make(map[string]int)
+		for _, entry := range entries {
+			values[entry.key], _ = strconv.Atoi(string(entry.value))
+		}
+
+		if values[second] > values[first] {
+			t.Fatal(fmt.Sprintf("Snapshot expected to be taken at a single point in time, got %s=%d and %s=%d", first, values[first], second, values[second]))
+		}
+	}
+
+	conn, err := net.Dial("tcp", startServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "save\r\n")
+	expected := "SERVER_ERROR No snapshot file configured\r\n"
+	response := make([]byte, len(expected))
+	io.ReadFull(conn, response)
+	if string(response) != expected {
+		t.Error(fmt.Sprintf("«save» command without a snapshot file returned %q, expected %q", response, expected))
+	}
+}
+
+func TestAppendLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whatever.aof")
+
+	cache := NewCache(1024 * 1024)
+	defer cache.Close()
+	aof, err := openAppendLog(cache, path, FsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Set("flushed", []byte("x"), 0, 0, 0)
+	cache.Flush(0)
+	cache.Set("foo", []byte("bar"), 3, 7, 0)
+	cache.Append("foo", []byte("baz"), 3, 0, 0)
+	cache.Set("deleted", []byte("x"), 0, 0, 0)
+	cache.Delete("deleted")
+	cache.Add("counter", []byte("5"), 0, 0, 0)
+	cache.Incr("counter", 2)
+	cache.Touch("counter", 3600)
+	_, _, _, casid, _ := cache.Gets("foo")
+	aof.Close()
+
+	// a torn record at the end is dropped
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{journalStore, 100, 1, 2})
+	file.Close()
+
+	for i := 0; i < 2; i++ {
+		restored := NewCache(1024 * 1024)
+		aof, err := openAppendLog(restored, path, FsyncNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if entry, ok := restored.Peek("foo"); !ok || string(entry.value) != "barbaz" || entry.priority != 3 || entry.flags != 7 || entry.casid != casid {
+			t.Error(fmt.Sprintf("Log replay restored unexpected entry %+v", entry))
+		}
+
+		if entry, ok := restored.Peek("counter"); !ok || string(entry.value) != "7" || entry.expires == 0 {
+			t.Error(fmt.Sprintf("Log replay restored unexpected counter %+v", entry))
+		}
+
+		for _, key := range []string{"flushed", "deleted"} {
+			if _, ok := restored.Peek(key); ok {
+				t.Error(fmt.Sprintf("Log replay expected to drop key %s", key))
+			}
+		}
+
+		// the second round replays the compacted log
+		if i == 0 {
+			before, _ := os.Stat(path)
+			if err := aof.Compact(); err != nil {
+				t.Fatal(err)
+			}
+			if after, _ := os.Stat(path); after.Size() >= before.Size() {
+				t.Error(fmt.Sprintf("Log compaction expected to shrink the log, got %d bytes from %d", after.Size(), before.Size()))
+			}
+		}
+
+		aof.Close()
+		restored.Close()
+	}
+
+	if _, err := openAppendLog(NewCache(1024), path, "sometimes"); err == nil {
+		t.Error("Unknown fsync policy expected to be rejected")
+	}
+
+	// evictions are logged too, so that evicted keys stay gone
+	path = filepath.Join(t.TempDir(), "evicted.aof")
+	value := []byte("x")
+	small := NewShardedCache(footprint("evicted", value, NewPriorityPolicy()), 1)
+	defer small.Close()
+	if aof, err = openAppendLog(small, path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+
+	small.Set("evicted", value, 0, 0, 0)
+	small.Set("pusher", value, 0, 0, 0)
+	small.Delete("evicted")
+	aof.Close()
+
+	restored := NewCache(1024 * 1024)
+	defer restored.Close()
+	if aof, err = openAppendLog(restored, path, FsyncNo); err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+
+	if _, ok := restored.Peek("evicted"); ok {
+		t.Error("Log replay expected to drop evicted key")
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primaryAddr := startServer(t)
+	primary := NewClient()
+	primary.AddServer(primaryAddr)
+	primary.Set([]byte("before"), 0, 0, 0, []byte("snapshot"))
+	primary.Set([]byte("deleted"), 0, 0, 0, []byte("x"))
+
+	replicaAddr := startConfiguredServer(t, func(server *Server) {
+		// the replica has room for what its primary evicts
+		server.cache = NewCache(4 * 1024 * 1024)
+		server.ReplicateFrom(primaryAddr)
+	})
+	replica := NewClient()
+	replica.AddServer(replicaAddr)
+
+	primary.Set([]byte("after"), 5, 0, 0, []byte("stream"))
+	primary.Delete([]byte("deleted"))
+
+	// the feed is asynchronous, so wait for the last change to arrive
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if value, _, _ := replica.Get([]byte("after")); value != nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Replica expected to receive the changes of its primary")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if value, _, err := replica.Get([]byte("before")); err != nil || string(value) != "snapshot" {
+		t.Error(fmt.Sprintf("Replica expected to load the snapshot of its primary, got %q: %v", value, err))
+	}
+
+	for time.Now().Before(deadline) {
+		if value, _, _ := replica.Get([]byte("deleted")); value == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value, _, _ := replica.Get([]byte("deleted")); value != nil {
+		t.Error("Replica expected to apply deletes of its primary")
+	}
+
+	if err := replica.Set([]byte("write"), 0, 0, 0, []byte("x")); err == nil {
+		t.Error("Replica expected to reject writes")
+	}
+
+	// a rejected quiet write leaves nothing behind for the next request
+	replica.SetQuiet([]byte("write"), 0, 0, 0, []byte("x"))
+	if value, _, err := replica.Get([]byte("before")); err != nil || string(value) != "snapshot" {
+		t.Error(fmt.Sprintf("Replica expected to reject quiet writes quietly, got %q: %v", value, err))
+	}
+
+	// the lag shows up with the first heartbeat
+	for time.Now().Before(deadline.Add(replicationHeartbeat)) {
+		stats, _ := replica.Stats()
+		if _, ok := stats[replicaAddr]["replication_lag_ms"]; ok {
+			if stats[replicaAddr]["role"] != "replica" || stats[replicaAddr]["primary_link_status"] != "up" {
+				t.Error(fmt.Sprintf("Replica reported unexpected stats %v", stats[replicaAddr]))
+			}
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	stats, _ := primary.Stats()
+	if stats[primaryAddr]["connected_replicas"] != "1" {
+		t.Error(fmt.Sprintf("Primary expected to report 1 connected replica, got %s", stats[primaryAddr]["connected_replicas"]))
+	}
+
+	// evictions reach the replica, or the keys deleted after them live on
+	primary.Set([]byte("evicted"), 0, 0, 0, []byte("x"))
+	deadline = time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if value, _, _ := replica.Get([]byte("evicted")); value != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	primary.Set([]byte("large"), 10, 0, 0, make([]byte, maxValueLength/2))
+	primary.Set([]byte("larger"), 10, 0, 0, make([]byte, maxValueLength/2))
+	primary.Delete([]byte("evicted"))
+
+	for time.Now().Before(deadline) {
+		if value, _, _ := replica.Get([]byte("evicted")); value == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value, _, _ := replica.Get([]byte("evicted")); value != nil {
+		t.Error("Replica expected to apply evictions of its primary")
+	}
+}
+
+// waitFor polls condition until it holds or a few seconds have passed.
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	return condition()
+}
+
+func TestCluster(t *testing.T) {
+	firstAddr := startConfiguredServer(t, func(server *Server) {
+		server.JoinCluster("")
+	})
+
+	client := NewClient()
+	if err := client.FetchRing(firstAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([][]byte, 200)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("cluster:%d", i))
+		if err := client.Set(keys[i], 0, 0, 0, keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var second *Server
+	secondAddr := startConfiguredServer(t, func(server *Server) {
+		second = server
+		server.JoinCluster("", firstAddr)
+	})
+
+	if !waitFor(func() bool { return client.FetchRing(firstAddr) == nil && len(client.servers()) == 2 }) {
+		t.Fatal("Member expected to join the ring")
+	}
+
+	moved := 0
+	for _, key := range keys {
+		if client.getServerAddr(key).String() == secondAddr {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("Joining member expected to own some keys")
+	}
+
+	readable := func() bool {
+		for _, key := range keys {
+			if value, _, _ := client.Get(key); !bytes.Equal(value, key) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !waitFor(readable) {
+		t.Error("Keys expected to migrate to their new owner")
+	}
+
+	for _, stat := range second.clusterStats() {
+		if stat.name == "cluster_adopted_items" && stat.value != uint64(moved) {
+			t.Error(fmt.Sprintf("Joining member expected to adopt %d keys, got %v", moved, stat.value))
+		}
+	}
+
+	if err := second.LeaveCluster(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.FetchRing(firstAddr); err != nil || len(client.servers()) != 1 {
+		t.Error(fmt.Sprintf("Leaving member expected to leave the ring, got %v: %v", client.servers(), err))
+	}
+
+	if !readable() {
+		t.Error("Keys expected to migrate back from the leaving member")
+	}
+
+	// batches are bound, and turned down before they are sent
+	member, err := net.Dial("tcp", firstAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer member.Close()
+
+	fmt.Fprintf(member, "migrate 5000000000\r\n")
+	member.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(member).ReadString('\n'); line != "CLIENT_ERROR Migration batch too large\r\n" {
+		t.Error(fmt.Sprintf("Huge migration batch expected to be rejected right away, got %q: %v", line, err))
+	}
+
+	// servers outside of a cluster take in no keys
+	conn, err := net.Dial("tcp", startServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "migrate 3\r\nabc\r\nmn\r\n")
+	expected := "SERVER_ERROR Not in a cluster\r\nMN\r\n"
+	response := make([]byte, len(expected))
+	if io.ReadFull(conn, response); string(response) != expected {
+		t.Error(fmt.Sprintf("«migrate» command outside of a cluster returned %q, expected %q", response, expected))
+	}
+
+	// a key sent again after it changed on the old owner replaces the first
+	// copy, but never a newer one
+	adopter := NewCache(1024 * 1024)
+	defer adopter.Close()
+
+	adopter.adopt([]*Entry{{key: "moved", value: []byte("first"), casid: 5}}, 10)
+	adopter.adopt([]*Entry{{key: "moved", value: []byte("second"), casid: 7}}, 10)
+	adopter.adopt([]*Entry{{key: "moved", value: []byte("stale"), casid: 6}}, 10)
+	if entry, _ := adopter.Peek("moved"); string(entry.value) != "second" {
+		t.Error(fmt.Sprintf("Migrated key expected to keep its newest copy, got %q", entry.value))
+	}
+
+	adopter.Set("moved", []byte("local"), 0, 0, 0)
+	adopter.adopt([]*Entry{{key: "moved", value: []byte("late"), casid: 9}}, 10)
+	if entry, _ := adopter.Peek("moved"); string(entry.value) != "local" {
+		t.Error(fmt.Sprintf("Migrated key expected to keep the copy written after adoption, got %q", entry.value))
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	server := NewServer(addr, false, 1024*1024)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Start()
+	}()
+
+	var idle net.Conn
+	for i := 0; i < 100 && idle == nil; i++ {
+		idle, _ = net.Dial("tcp", addr)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if idle == nil {
+		t.Fatal("Cannot start server at " + addr)
+	}
+	defer idle.Close()
+
+	busy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	// the server waits for the rest of the data block
+	fmt.Fprintf(busy, "set drain 0 0 0 5\r\nab")
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+		t.Error(fmt.Sprintf("Idle connection expected to be closed, got %v", err))
+	}
+
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(busy, "cde\r\n")
+	reader := bufio.NewReader(busy)
+	if line, err := reader.ReadString('\n'); line != msgStored {
+		t.Error(fmt.Sprintf("Running command expected to finish, got %q: %v", line, err))
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Error(fmt.Sprintf("Connection expected to be closed after its command, got %v", err))
+	}
+
+	if err := <-shutdown; err != nil {
+		t.Error(fmt.Sprintf("Shutdown expected to drain every connection, got %v", err))
+	}
+	if err := <-stopped; err != ErrServerClosed {
+		t.Error(fmt.Sprintf("Start expected to return ErrServerClosed, got %v", err))
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Server expected to stop accepting connections")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	var server *Server
+	addr := startConfiguredServer(t, func(s *Server) {
+		server = s
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the data block never completes
+	fmt.Fprintf(conn, "set stuck 0 0 0 5\r\nab")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error(fmt.Sprintf("Shutdown expected to give up at the deadline, got %v", err))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Connection expected to be closed at the deadline")
+	}
+}
+
+func TestConnectionErrors(t *testing.T) {
+	var server *Server
+	addr := startConfiguredServer(t, func(s *Server) {
+		server = s
+	})
+
+	client := NewClient()
+	client.AddServer(addr)
+
+	stop := make(chan struct{})
+	failures := make(chan error, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(key []byte) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if err := client.Set(key, 0, 0, 0, key); err != nil {
+					failures <- err
+					return
+				}
+				if value, _, err := client.Get(key); err != nil || !bytes.Equal(value, key) {
+					failures <- fmt.Errorf("Got %q for %s: %v", value, key, err)
+					return
+				}
+			}
+		}([]byte(fmt.Sprintf("healthy:%d", i)))
+	}
+
+	// every one of these is reset in the middle of a command
+	broken := []string{
+		"set broken 0 0 0 100\r\nabc",
+		"get broken",
+		"\x80\x00\x00",
+	}
+	for round := 0; round < 10; round++ {
+		for _, data := range broken {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write([]byte(data))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	fmt.Fprintf(conn, "get %s\r\n", bytes.Repeat([]byte("x"), 8192))
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); line != "CLIENT_ERROR Line too long\r\n" {
+		t.Error(fmt.Sprintf("Overlong line expected to be rejected, got %q: %v", line, err))
+	}
+	// the rest of the line is never read, so the close may come as a reset
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Connection expected to be closed after an overlong line")
+	}
+
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-failures:
+		t.Error(fmt.Sprintf("Healthy clients expected to keep working: %v", err))
+	default:
+	}
+
+	expected := uint64(len(broken)*10 + 1)
+	if !waitFor(func() bool { return atomic.LoadUint64(&server.stats.connectionErrors) == expected }) {
+		t.Error(fmt.Sprintf("Expected %d connection errors, got %d", expected, atomic.LoadUint64(&server.stats.connectionErrors)))
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	addr := startConfiguredServer(t, func(server *Server) {
+		server.SetIdleTimeout(100 * time.Millisecond)
+	})
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	fmt.Fprintf(stalled, "set stalled 0 0 0 5\r\nab")
+
+	for _, conn := range []net.Conn{idle, stalled} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Error(fmt.Sprintf("Silent connection expected to be closed, got %v", err))
+		}
+	}
+
+	client := NewClient()
+	client.AddServer(addr)
+	stats, err := client.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[addr]["idle_kicks"] != "2" || stats[addr]["connection_errors"] != "0" {
+		t.Error(fmt.Sprintf("Expected 2 idle kicks and no errors, got %s and %s", stats[addr]["idle_kicks"], stats[addr]["connection_errors"]))
+	}
+}
+
+func TestLimits(t *testing.T) {
+	conn, err := net.Dial("tcp", startConfiguredServer(t, func(server *Server) {
+		server.SetMaxKeyLength(8)
+		server.SetMaxValueLength(16)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// every rejected data block is discarded, so the next command still works
+	r := bufio.NewReader(conn)
+	exchange := []struct {
+		request  string
+		response string
+	}{
+		{"set longerkey 0 0 0 3\r\nbar\r\nget foo\r\n", "CLIENT_ERROR Key too long\r\nEND\r\n"},
+		{"set foo 0 0 0 17\r\n" + strings.Repeat("x", 17) + "\r\nget foo\r\n", "CLIENT_ERROR Object too large for cache\r\nEND\r\n"},
+		{"set f\x01o 0 0 0 3\r\nbar\r\n", "CLIENT_ERROR Invalid character in key\r\n"},
+		{"set foo 0 0 0 3\r\nbarbaz\r\n", "CLIENT_ERROR Bad data chunk\r\n"},
+		{"set foo 0 0 0 3\r\nbar\r\nget foo\r\n", "STORED\r\nVALUE foo 0 3 \r\nbar\r\nEND\r\n"},
+		{"set foo 0 0 0 17 noreply\r\n" + strings.Repeat("x", 17) + "\r\nset longerkey 0 0 0 3 noreply\r\nbar\r\nget foo\r\n", "VALUE foo 0 3 \r\nbar\r\nEND\r\n"},
+		{"get foo longerkey\r\n", "CLIENT_ERROR Key too long\r\n"},
+		{"delete f\x7fo\r\n", "CLIENT_ERROR Invalid character in key\r\n"},
+		{"ms foo 17\r\n" + strings.Repeat("x", 17) + "\r\nmn\r\n", "CLIENT_ERROR Object too large for cache\r\nMN\r\n"},
+		{"mg longerkey v\r\n", "CLIENT_ERROR Key too long\r\n"},
+	}
+
+	for _, e := range exchange {
+		if _, err := conn.Write([]byte(e.request)); err != nil {
+			t.Fatal(err)
+		}
+
+		response := make([]byte, len(e.response))
+		if _, err := io.ReadFull(r, response); err != nil || string(response) != e.response {
+			t.Error(fmt.Sprintf("Command %q returned %q, expected %q", e.request, response, e.response))
+		}
+	}
+
+	// the key outlives the read buffer, which a late data block refills
+	fmt.Fprintf(conn, "set other 0 0 0 3\r\n")
+	time.Sleep(50 * time.Millisecond)
+	fmt.Fprintf(conn, "baz\r\nget other\r\n")
+	expected := "STORED\r\nVALUE other 0 3 \r\nbaz\r\nEND\r\n"
+	response := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(r, response); err != nil || string(response) != expected {
+		t.Error(fmt.Sprintf("Data block sent apart from its command returned %q, expected %q", response, expected))
+	}
+
+	// the answer comes before the data block, which is never sent
+	fmt.Fprintf(conn, "set foo 0 0 0 5000000000\r\n")
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := r.ReadString('\n'); line != "CLIENT_ERROR Object too large for cache\r\n" {
+		t.Error(fmt.Sprintf("Huge value expected to be rejected right away, got %q: %v", line, err))
+	}
+
+	// lines are read whole however long keys are allowed to be
+	long, err := net.Dial("tcp", startConfiguredServer(t, func(server *Server) {
+		server.SetMaxKeyLength(8192)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer long.Close()
+
+	key := strings.Repeat("k", 8192)
+	fmt.Fprintf(long, "set %s 0 0 0 3 noreply\r\nbar\r\nget %s\r\n", key, key)
+	expected = "VALUE " + key + " 0 3 \r\nbar\r\nEND\r\n"
+	response = make([]byte, len(expected))
+	long.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(long, response); err != nil || string(response) != expected {
+		t.Error(fmt.Sprintf("Key of the configured length expected to be stored, got %.40q: %v", response, err))
+	}
+}